@@ -21,17 +21,42 @@ package main
 
 /*
 	The handler command is an AWS Lambda compatible command that will
-	process Mastodon push notifications via AWS LambdaFunctionURLRequest
-	events received from a Mastodon instance and publish them to one or
-	more SNS targets.
+	process Mastodon push notifications received from a Mastodon instance
+	and publish them to one or more SNS targets. The lambda can be invoked
+	via a function URL, an API Gateway REST or HTTP API or an application
+	load balancer; all of these events are normalized into one request type.
 
 	The SNS targets are encoded into the request path. The lambda must be
 	configured such that it can publish notifications to _ALL_ of the
 	targets that are encoded in the request path.  If any target fails to
 	publish then the request will return a failure to the caller, which
-	usually results in retries and duplicate messages being received.
-	Because of this, subscribers to the target topics _MUST_ be idempodent
-	and must be prepared to process the same message multiple times.
+	usually results in retries. Successful deliveries are recorded in a
+	delivery ledger (DynamoDB when MSTDN_LEDGER_TABLE is set, memory otherwise)
+	so that a retry is only published to the targets that have not yet
+	succeeded. The ledger is best effort; subscribers to the target topics
+	_MUST_ still be idempodent and must be prepared to process the same
+	message multiple times.
+
+	When a dead letter destination is configured (MSTDN_DEAD_LETTER), a target
+	that keeps failing has the notification moved to the dead letter destination
+	once MSTDN_DEAD_LETTER_MAX_ATTEMPTS attempts have failed. The request is then
+	reported as a success so Mastodon stops retrying it.
+
+	When MSTDN_DEDUP_WINDOW is set, the notification_id of each decrypted
+	notification is remembered for that long once it has been delivered to all
+	of its targets; repeats received within the window are dropped.
+
+	Requests can be restricted to allowlisted source CIDRs (MSTDN_ALLOW_CIDRS)
+	and senders (MSTDN_ALLOW_SENDERS) and rate limited per sending instance
+	(MSTDN_RATE_LIMIT); rejected requests are answered with a 403 or 429.
+
+	When MSTDN_ENRICH is set, the full notification is fetched from the Mastodon
+	API and added to the forwarded notification.
+
+	Per target rules (MSTDN_TARGET_CONFIG) may filter which notifications are
+	published to each target, transform the published body with a template and
+	wrap it in a versioned envelope of request metadata; a notification filtered
+	out for a target is treated as done for that target.
 
 	The lambda's function URL must be requested with a path such that each
 	segment of the path is a URL safe base64 encoding of an SNS topic ARN.
@@ -51,6 +76,15 @@ package main
 
 	https://gitlab.com/ddb_db/mstdnlambda
 
+	Paths starting with /_ are reserved for the operational endpoints: GET
+	/_health, GET /_version and, when MSTDN_SELFTEST_TOKEN is set, POST
+	/_selftest/<targets>, which runs a synthetic notification through the
+	pipeline for the given targets without publishing it.
+
+	The command can also run as a standalone HTTP server outside of Lambda
+	(i.e. in a container) with the -listen flag, i.e. -listen :8080; each HTTP
+	request is adapted into a LambdaFunctionURLRequest and handled the same way.
+
 	This command is also capable of running in development mode, which reads an event
 	from a json file on the local filesystem and "publishes" the events to a log file
 	intead of interacting with AWS.  See the project site for more details.
@@ -60,29 +94,86 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/sirupsen/logrus"
+	"github.com/slugger/mstdnlambda/internal/allowlist"
 	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/deadletter"
+	"github.com/slugger/mstdnlambda/internal/dedup"
 	"github.com/slugger/mstdnlambda/internal/devenv"
+	"github.com/slugger/mstdnlambda/internal/enrich"
+	"github.com/slugger/mstdnlambda/internal/envelope"
 	"github.com/slugger/mstdnlambda/internal/http"
 	"github.com/slugger/mstdnlambda/internal/jwt"
+	"github.com/slugger/mstdnlambda/internal/ledger"
 	"github.com/slugger/mstdnlambda/internal/logging"
 	"github.com/slugger/mstdnlambda/internal/notify"
+	"github.com/slugger/mstdnlambda/internal/ops"
 	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/slugger/mstdnlambda/internal/ratelimit"
+	"github.com/slugger/mstdnlambda/internal/rules"
+	"github.com/slugger/mstdnlambda/internal/server"
+	"github.com/slugger/mstdnlambda/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// newNotifier creates the Notifier for a target; replaced in tests
+var newNotifier = notify.New
+
+// deliveryLedger records the targets each notification has been delivered to across invocations
+var deliveryLedger ledger.Ledger
+
+// deadLetters receives notifications that exhausted their delivery attempts; nil if not configured
+var deadLetters deadletter.Queue
+
+// dedupStore remembers the notifications delivered within the configured dedup window
+var dedupStore dedup.Store
+
+// enricher adds the full notification from the Mastodon API; nil if enrichment is disabled
+var enricher *enrich.Enricher
+
+// targetRules holds the per target delivery rules; nil if none are configured
+var targetRules *rules.Rules
+
+// limiter limits the rate of requests accepted from each source; nil if rate limiting is disabled
+var limiter *ratelimit.Limiter
+
 func main() {
 	flag.Parse()
 	devenv.InitArgs()
 	cfg.ParseConfig()
 	logging.Reset()
-	if !devenv.IsActive() {
-		lambda.Start(handleRequest)
-	} else {
+	deliveryLedger = ledger.New()
+	dedupStore = dedup.New()
+	enricher = enrich.New()
+	limiter = ratelimit.New()
+	var err error
+	if deadLetters, err = deadletter.New(); err != nil {
+		panic(err)
+	}
+	if targetRules, err = rules.New(); err != nil {
+		panic(err)
+	}
+	if err = tracing.Setup(context.Background()); err != nil {
+		panic(err)
+	}
+	switch {
+	case server.IsActive():
+		if err = server.ListenAndServe(handleRequest); err != nil {
+			panic(err)
+		}
+	case !devenv.IsActive():
+		lambda.Start(handleEvent)
+	default:
 		triggerDevEnv()
 	}
 }
@@ -94,15 +185,9 @@ func triggerDevEnv() {
 		panic(fmt.Errorf("[GetEventData() failed] %w", err))
 	}
 
-	var event events.LambdaFunctionURLRequest
-	err = json.Unmarshal(data, &event)
+	resp, err := handleEvent(context.TODO(), data)
 	if err != nil {
-		panic(fmt.Errorf("[event unmarshal failed] %w", err))
-	}
-
-	resp, err := handleRequest(context.TODO(), event)
-	if err != nil {
-		panic(fmt.Errorf("[handleRequest failed] %w", err))
+		panic(fmt.Errorf("[handleEvent failed] %w", err))
 	} else {
 		output, err := json.Marshal(resp)
 		if err != nil {
@@ -112,8 +197,117 @@ func triggerDevEnv() {
 	}
 }
 
+// handleEvent handles any of the supported event types, responding in the format expected by the event's source
+func handleEvent(ctx context.Context, data json.RawMessage) (interface{}, error) {
+	event, err := http.ParseEvent(data)
+	if err != nil {
+		return nil, fmt.Errorf("[event parse failed] %w", err)
+	}
+	resp, err := handle(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	return http.EncodeFor(event, resp), nil
+}
+
+// handleRequest handles a lambda function URL event
 func handleRequest(ctx context.Context, event events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
-	log := logging.GetLogForCategory(logging.LambdaCategory)
+	return handle(ctx, http.FromFunctionURL(event))
+}
+
+func handle(ctx context.Context, event *http.Request) (*events.LambdaFunctionURLResponse, error) {
+	id := requestID(ctx, event)
+	ctx = logging.NewContext(ctx, logging.Log.WithField("requestId", id))
+	if strings.HasPrefix(event.Path, ops.Prefix) {
+		return handleOps(ctx, event)
+	}
+
+	ctx, span := tracing.Start(tracing.Extract(ctx, event.Headers), "request", attribute.String("request_id", id))
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		ctx = logging.WithFields(ctx, logrus.Fields{"traceId": sc.TraceID().String()})
+	}
+	resp, err := process(ctx, event, nil)
+	status := 500
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	tracing.EndRequest(span, status, err)
+	if ferr := tracing.Flush(ctx); ferr != nil {
+		logging.GetLogForContext(ctx, logging.LambdaCategory).WithField("err", ferr).Warn("trace flush failed")
+	}
+	return resp, err
+}
+
+// handleOps serves the operational endpoints
+func handleOps(ctx context.Context, event *http.Request) (*events.LambdaFunctionURLResponse, error) {
+	var method string
+	switch {
+	case event.Path == ops.HealthPath, event.Path == ops.VersionPath:
+		method = "GET"
+	case event.Path == ops.SelfTestPath, strings.HasPrefix(event.Path, ops.SelfTestPath+"/"):
+		method = "POST"
+	default:
+		return http.EncodeResponse(404, "not found"), nil
+	}
+	if event.Method != "" && !strings.EqualFold(event.Method, method) {
+		resp := http.EncodeError(fmt.Errorf("%w: %s", http.ErrMethodNotAllowed, event.Method))
+		resp.Headers["Allow"] = method
+		return resp, nil
+	}
+
+	switch event.Path {
+	case ops.HealthPath:
+		h := ops.CheckHealth()
+		if !h.IsHealthy() {
+			return http.EncodeJSON(503, h), nil
+		}
+		return http.EncodeJSON(200, h), nil
+	case ops.VersionPath:
+		return http.EncodeJSON(200, ops.BuildVersion()), nil
+	default:
+		return selfTest(ctx, event)
+	}
+}
+
+// selfTest runs a synthetic notification through the pipeline without publishing it and reports the outcome of each stage
+func selfTest(ctx context.Context, event *http.Request) (*events.LambdaFunctionURLResponse, error) {
+	switch err := ops.Authorize(event); {
+	case errors.Is(err, ops.ErrSelfTestDisabled):
+		return http.EncodeResponse(404, "not found"), nil
+	case err != nil:
+		return http.EncodeResponse(401, "unauthorized"), nil
+	}
+
+	report := ops.NewReport()
+	req, err := ops.NewRequest(event)
+	report.Record("request build", err)
+	if err == nil {
+		if _, err = process(ctx, req, report); err != nil {
+			report.Record("pipeline", err)
+		}
+	}
+	result := struct {
+		Status string `json:"status"`
+		*ops.Report
+	}{"ok", report}
+	if !report.Passed() {
+		result.Status = "fail"
+		return http.EncodeJSON(500, result), nil
+	}
+	return http.EncodeJSON(200, result), nil
+}
+
+// process runs a push request through the pipeline; when report is non-nil the request is a self test, the outcome of each stage is recorded in it and nothing is published or remembered
+func process(ctx context.Context, event *http.Request, report *ops.Report) (*events.LambdaFunctionURLResponse, error) {
+	ctx = logging.WithFields(ctx, logrus.Fields{"source": event.Source.String()})
+	log := logging.GetLogForContext(ctx, logging.LambdaCategory)
+	receivedAt := time.Now()
+	metrics := logging.NewMetrics()
+	if report.IsDryRun() {
+		metrics = nil
+	}
+	metrics.Count(logging.MetricReceived, nil)
+	defer func() { metrics.Latency("total", time.Since(receivedAt), nil) }()
 
 	var vjwt *jwt.VerifiableJwt
 	var req *payload.EncryptedPayload
@@ -121,57 +315,339 @@ func handleRequest(ctx context.Context, event events.LambdaFunctionURLRequest) (
 
 	logging.LogAsJSON(log, logrus.DebugLevel, event, "event logged", false)
 
-	if vjwt, err = http.ExtractJwt(event); err != nil {
+	err = http.CheckRequest(event)
+	report.Record("request check", err)
+	if err != nil {
+		logging.LogAsJSON(log, logrus.ErrorLevel, event, "request check failed", true)
+		e := fmt.Errorf("[request check failed] %w", err)
+		return http.EncodeError(e), nil
+	}
+
+	if report.IsDryRun() {
+		report.Skip("source allowlist", "self test")
+	} else if err = allowlist.CheckSource(event.SourceIP); err != nil {
+		log.WithField("sourceIP", event.SourceIP).Warn("source not allowlisted")
+		e := fmt.Errorf("[source check failed] %w", err)
+		return http.EncodeError(e), nil
+	}
+
+	_, span := tracing.Start(ctx, "extract")
+	vjwt, err = http.ExtractJwt(event)
+	report.Record("jwt extract", err)
+	if err != nil {
+		tracing.End(span, err)
 		logging.LogAsJSON(log, logrus.ErrorLevel, event, "jwt extract failed", true)
+		metrics.Count(logging.MetricJwtFailed, nil)
 		e := fmt.Errorf("[jwt extract failed] %w", err)
-		return nil, e
+		return http.EncodeError(e), nil
 	}
 
-	if req, err = http.ExtractPayload(event); err != nil {
+	req, err = http.ExtractPayload(event)
+	tracing.End(span, err)
+	report.Record("payload extract", err)
+	if err != nil {
 		logging.LogAsJSON(log, logrus.ErrorLevel, event, "payload extract failed", true)
 		e := fmt.Errorf("[payload extract failed] %w", err)
-		return nil, e
+		return http.EncodeError(e), nil
 	}
 
 	if !cfg.Cfg.IsSkipJwtVerify() {
-		if err = jwt.Verify(vjwt); err != nil {
+		_, span = tracing.Start(ctx, "verify")
+		start := time.Now()
+		err = jwt.Verify(vjwt)
+		metrics.Latency("jwt", time.Since(start), nil)
+		tracing.End(span, err)
+		report.Record("jwt verify", err)
+		if err != nil {
 			logging.LogAsJSON(log, logrus.ErrorLevel, event, "jwt verify failed", true)
+			metrics.Count(logging.MetricJwtFailed, nil)
 			e := fmt.Errorf("[jwt verify failed] %w", err)
-			return nil, e
+			return http.EncodeError(http.WithStatus(403, e)), nil
 		}
 	} else {
 		log.Warn("JWT VERIFICATION IS DISABLED!")
+		report.Skip("jwt verify", "MSTDN_SKIP_JWT_VERIFY is set")
+	}
+
+	claims, err := jwt.ParseClaims(vjwt)
+	if err != nil {
+		log.WithField("err", err).Warn("jwt claims parse failed")
+		claims = &jwt.Claims{}
+	}
+	instance := sourceInstance(claims)
+	ctx = logging.WithFields(ctx, logrus.Fields{"instance": instance})
+	log = log.WithField("instance", instance)
+
+	var sender string
+	if report.IsDryRun() {
+		report.Skip("sender allowlist", "self test")
+		report.Skip("rate limit", "self test")
+	} else {
+		sender, err = allowlist.CheckSender(claims.Subject, vjwt.PublicKey)
+		if err != nil {
+			log.WithField("sub", claims.Subject).Warn("sender not allowlisted")
+			e := fmt.Errorf("[sender check failed] %w", err)
+			return http.EncodeError(e), nil
+		}
+		if resp := rateLimited(ctx, log, sender, event.SourceIP); resp != nil {
+			return resp, nil
+		}
 	}
 
 	var msg string
+	_, span = tracing.Start(ctx, "decrypt")
+	start := time.Now()
 	msg, err = payload.Decrypt(req)
+	metrics.Latency("decrypt", time.Since(start), nil)
+	tracing.End(span, err)
+	report.Record("payload decrypt", err)
 	if err != nil {
+		metrics.Count(logging.MetricDecryptFailed, nil)
 		b64Payload := base64.StdEncoding.EncodeToString(req.Data)
 		logging.LogAsJSON(log.WithField("data", b64Payload), logrus.ErrorLevel, event, "payload decrypt failed", false)
 		e := fmt.Errorf("[payload decrypt failed] %w", err)
-		return nil, e
+		return http.EncodeError(e), nil
+	}
+	log.WithField("payload", payload.Redact(msg)).Debug("payload received")
+
+	var notification *payload.Notification
+	start = time.Now()
+	notification, err = payload.Parse(msg)
+	metrics.Latency("parse", time.Since(start), nil)
+	report.Record("notification parse", err)
+	if err != nil {
+		log.WithField("err", err).Error("notification parse failed")
+		e := fmt.Errorf("[notification parse failed] %w", err)
+		return http.EncodeError(e), nil
 	}
-	log.WithField("payload", msg).Debug("payload received")
+	ctx = logging.WithFields(ctx, logrus.Fields{"notificationId": notification.NotificationID})
+	log = log.WithField("notificationId", notification.NotificationID)
 
 	targets, err := http.ExtractTargets(event)
+	if err == nil && len(targets) == 0 {
+		err = http.ErrUnknownTarget
+	}
+	report.Record("targets extract", err)
 	if err != nil {
-		logging.LogAsJSON(log, logrus.ErrorLevel, event.RawPath, "targets extract failed", false)
+		logging.LogAsJSON(log, logrus.ErrorLevel, event.Path, "targets extract failed", false)
 		e := fmt.Errorf("[targets extract failed] %w", err)
-		return nil, e
+		return http.EncodeError(e), nil
+	}
+
+	dedupKey := ""
+	if dedup.IsEnabled() {
+		dedupKey = notification.Key()
+		if seen, err := dedupStore.Seen(ctx, dedupKey); err != nil {
+			log.WithField("err", err).Warn("dedup lookup failed; delivering anyway")
+		} else if seen {
+			log.WithField("dedupKey", dedupKey).Info("duplicate notification dropped")
+			return http.EncodeResponse(200, "duplicate"), nil
+		}
 	}
 
-	statusCode := 201
-	statusTxt := "ok"
+	var failure error
+	fingerprint := ledger.Fingerprint(msg)
+	forwarded := msg
+	if report.IsDryRun() {
+		report.Skip("enrich", "the self test notification does not exist on the instance")
+	} else {
+		start = time.Now()
+		forwarded, notification = enriched(ctx, log, msg, notification, sender)
+		if enricher != nil {
+			metrics.Latency("enrich", time.Since(start), logging.Dimensions{logging.DimNotificationType: notification.NotificationType})
+		}
+	}
+	message := notify.NewMessage(forwarded, notification, instance)
+	data := &rules.TemplateData{
+		Notification: notification,
+		Document:     notification.Document(),
+		Raw:          forwarded,
+		Instance:     instance,
+		ReceivedAt:   receivedAt,
+	}
+	meta := &envelope.Metadata{
+		ReceivedAt:     receivedAt,
+		Instance:       instance,
+		SubscriptionID: envelope.SubscriptionID(event.Path),
+		RequestID:      requestID(ctx, event),
+		JwtSub:         claims.Subject,
+		JwtExp:         claims.ExpiresAt,
+		Encoding:       payload.Encoding,
+	}
 	for _, t := range targets {
-		n := notify.New(t)
-		if err = n.Send(msg); err != nil {
+		tctx := logging.WithFields(ctx, logrus.Fields{"target": t, "fingerprint": fingerprint})
+		tlog := logging.GetLogForContext(tctx, logging.LambdaCategory)
+		rule := targetRules.For(t)
+		if matched, err := rule.Matches(notification.Document()); err != nil {
+			tlog.WithField("err", err).Warn("target filter failed; delivering anyway")
+			report.Record("filter "+t, err)
+		} else if !matched {
+			tlog.Debug("notification filtered out for target; skipped")
+			report.Note("filter "+t, "filtered out")
+			continue
+		}
+
+		delivered, err := deliveryLedger.IsDelivered(tctx, fingerprint, t)
+		if err != nil {
+			tlog.WithField("err", err).Warn("ledger lookup failed; delivering anyway")
+		} else if delivered {
+			tlog.Info("already delivered to target; skipped")
+			continue
+		}
+
+		n := newNotifier(t)
+		body, err := rule.Render(data)
+		if err == nil && rule.IsEnveloped() {
+			body, err = envelope.Wrap(meta, body)
+		}
+		if report.IsDryRun() {
+			report.Record("render "+t, err)
+			if err == nil {
+				report.Skip("publish "+t, "self test")
+			}
+			continue
+		}
+		dims := targetDimensions(notification, t)
+		tmetrics := metrics.WithProperty(logging.PropTarget, t)
+		if err == nil {
+			sctx, span := tracing.Start(tctx, "send", attribute.String("target", t), attribute.String("notification_type", notification.NotificationType))
+			start = time.Now()
+			err = n.Send(sctx, message.WithBody(body).WithAttributes(tracing.Inject(sctx)))
+			tmetrics.Latency("publish", time.Since(start), dims)
+			tracing.End(span, err)
+		}
+		if err != nil {
+			tmetrics.Count(logging.MetricPublishFailed, dims)
 			e := fmt.Errorf("[notification failed] %w", err)
-			logging.LogAsJSON(log.WithField("err", e), logrus.ErrorLevel, n, "notification failed", false)
-			statusCode = 500
-			statusTxt = "fail"
-			break
+			logging.LogAsJSON(tlog.WithField("err", e), logrus.ErrorLevel, n, "notification failed", false)
+			// the record holds what the target would have received so it can be replayed; if the policy can't be applied, the token is redacted instead
+			dead, rerr := rule.Raw(data)
+			if rerr != nil {
+				dead = payload.Redact(msg)
+			}
+			if deadLettered(tctx, tlog, fingerprint, t, dead, e) {
+				continue
+			}
+			failure = worstFailure(failure, e)
+			continue
+		}
+
+		tmetrics.Count(logging.MetricPublished, dims)
+		if err = deliveryLedger.MarkDelivered(tctx, fingerprint, t); err != nil {
+			tlog.WithField("err", err).Warn("ledger update failed; target may receive duplicates on retry")
 		}
 	}
 
-	return http.EncodeResponse(statusCode, statusTxt), nil
+	if failure != nil {
+		return http.EncodeError(failure), nil
+	}
+
+	if dedupKey != "" && !report.IsDryRun() {
+		if err = dedupStore.Record(ctx, dedupKey, cfg.Cfg.DedupWindow()); err != nil {
+			log.WithField("err", err).Warn("dedup record failed")
+		}
+	}
+
+	return http.EncodeResponse(201, "ok"), nil
+}
+
+// rateLimited returns the response rejecting the request if its source exceeded its rate limit, nil otherwise; the source is the allowlisted sender whose pinned key signed the request or, if senders are not allowlisted, the source IP reported by AWS. Nothing else identifying the sender can be trusted. The request is allowed if the limit cannot be checked
+func rateLimited(ctx context.Context, log *logrus.Entry, sender string, sourceIP string) *events.LambdaFunctionURLResponse {
+	source := sender
+	if source == "" {
+		source = sourceIP
+	}
+	allowed, err := limiter.Allow(ctx, source)
+	if err != nil {
+		log.WithField("err", err).Warn("rate limit check failed; allowing request")
+		return nil
+	}
+	if allowed {
+		return nil
+	}
+	log.WithField("rateSource", source).Warn("source rate limited")
+	return http.EncodeError(fmt.Errorf("[rate limit exceeded] %w: %s", ratelimit.ErrRateLimited, source))
+}
+
+// failurePriority orders the statuses reporting target failures; a server fault, which includes a target rejected by SNS, outranks a downstream outage, which outranks throttling
+var failurePriority = map[int]int{500: 4, 503: 3, 429: 2, 400: 1}
+
+// worstFailure returns whichever of the two target failures should decide the status of the response
+func worstFailure(current error, next error) error {
+	if current == nil || failurePriority[http.StatusCode(next)] > failurePriority[http.StatusCode(current)] {
+		return next
+	}
+	return current
+}
+
+// deadLettered records the failed attempt and, once the target has used up its attempts, moves the notification to the dead letter destination; returns true iff the notification was dead lettered
+func deadLettered(ctx context.Context, log *logrus.Entry, fingerprint string, target string, msg string, cause error) bool {
+	if deadLetters == nil {
+		return false
+	}
+
+	attempts, err := deliveryLedger.RecordFailure(ctx, fingerprint, target)
+	if err != nil {
+		log.WithField("err", err).Warn("ledger failure count failed")
+		return false
+	}
+	if attempts < cfg.Cfg.DeadLetterMaxAttempts() {
+		return false
+	}
+
+	if err = deadLetters.Put(ctx, deadletter.NewRecord(fingerprint, target, msg, attempts, cause)); err != nil {
+		log.WithField("err", err).Error("dead letter failed")
+		return false
+	}
+	if err = deliveryLedger.MarkDelivered(ctx, fingerprint, target); err != nil {
+		log.WithField("err", err).Warn("ledger update failed; dead lettered target may be retried")
+	}
+	log.WithField("attempts", attempts).Warn("notification dead lettered")
+	return true
+}
+
+// enriched returns msg with the full notification from the Mastodon API added when enrichment is enabled; the notification is forwarded as received if it cannot be enriched. sender is the allowlist entry the request was verified against
+func enriched(ctx context.Context, log *logrus.Entry, msg string, notification *payload.Notification, sender string) (string, *payload.Notification) {
+	if enricher == nil {
+		return msg, notification
+	}
+	result, err := enricher.Enrich(ctx, msg, notification, sender)
+	if err != nil {
+		log.WithField("err", err).Warn("notification enrich failed; forwarding as received")
+		return msg, notification
+	}
+	n, err := payload.Parse(result)
+	if err != nil {
+		log.WithField("err", err).Warn("enriched notification parse failed; forwarding as received")
+		return msg, notification
+	}
+	return result, n
+}
+
+// requestID returns the id of the lambda invocation handling the event; the id the event source assigned to the request when not running in lambda
+func requestID(ctx context.Context, event *http.Request) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	return event.RequestID
+}
+
+// sourceInstance returns the domain of the Mastodon instance that sent the request; the configured instance takes precedence over the domain of the JWT subject
+func sourceInstance(claims *jwt.Claims) string {
+	if instance := cfg.Cfg.Instance(); instance != "" {
+		return instance
+	}
+	return jwt.SubjectDomain(claims.Subject)
+}
+
+// targetDimensions returns the metric dimensions for delivering the notification to the target; the target itself is a metric property since a dimension per target would be billed as metrics of its own
+func targetDimensions(notification *payload.Notification, target string) logging.Dimensions {
+	service := "unknown"
+	if a, err := arn.Parse(target); err == nil {
+		service = a.Service
+	}
+	return logging.Dimensions{
+		logging.DimNotificationType: notification.NotificationType,
+		logging.DimTargetService:    service,
+	}
 }
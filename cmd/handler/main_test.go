@@ -0,0 +1,1019 @@
+package main
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	ece "github.com/crow-misia/http-ece"
+	jwtlib "github.com/golang-jwt/jwt/v4"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/deadletter"
+	"github.com/slugger/mstdnlambda/internal/dedup"
+	"github.com/slugger/mstdnlambda/internal/enrich"
+	"github.com/slugger/mstdnlambda/internal/envelope"
+	"github.com/slugger/mstdnlambda/internal/ledger"
+	"github.com/slugger/mstdnlambda/internal/logging"
+	"github.com/slugger/mstdnlambda/internal/notify"
+	"github.com/slugger/mstdnlambda/internal/ops"
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/slugger/mstdnlambda/internal/ratelimit"
+	"github.com/slugger/mstdnlambda/internal/rules"
+	"github.com/slugger/mstdnlambda/internal/server"
+	"github.com/slugger/mstdnlambda/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testMessage = `{"notification_id":"1","notification_type":"mention","title":"t","body":"b","access_token":"tok","preferred_locale":"en","icon":"https://foo.com/icon.png"}`
+
+func TestHandleRequestDeliversToAllTargets(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, []string{"target1", "target2"}, hub.sent)
+	assert.Equal(t, testMessage, hub.messages["target1"])
+}
+
+func TestHandleRequestOverHTTP(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	srv := httptest.NewServer(server.NewHandler(handleRequest))
+	defer srv.Close()
+
+	event := keys.encryptedEvent(testMessage, "target1", "target2")
+	body, err := base64.StdEncoding.DecodeString(event.Body)
+	assert.Nil(t, err)
+	req, err := nethttp.NewRequest(nethttp.MethodPost, srv.URL+event.RawPath, bytes.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range event.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := srv.Client().Do(req)
+	if assert.Nil(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, 201, resp.StatusCode)
+		assert.Equal(t, []string{"target1", "target2"}, hub.sent)
+		assert.Equal(t, testMessage, hub.messages["target2"])
+	}
+}
+
+func TestHandleEventSupportsAllSources(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	// API Gateway REST API on a custom domain with a base path mapping
+	event := keys.encryptedEvent(testMessage, "target1")
+	event.RequestContext.DomainName = "push.example.com"
+	rest := events.APIGatewayProxyRequest{
+		HTTPMethod:      "POST",
+		Path:            "/push" + event.RawPath,
+		PathParameters:  map[string]string{"proxy": strings.TrimPrefix(event.RawPath, "/")},
+		Headers:         event.Headers,
+		Body:            event.Body,
+		IsBase64Encoded: true,
+		RequestContext:  events.APIGatewayProxyRequestContext{DomainName: "push.example.com"},
+	}
+	alb := events.ALBTargetGroupRequest{
+		HTTPMethod:      "POST",
+		Path:            event.RawPath,
+		Headers:         map[string]string{"host": "push.example.com"},
+		Body:            event.Body,
+		IsBase64Encoded: true,
+		RequestContext:  events.ALBTargetGroupRequestContext{ELB: events.ELBContext{TargetGroupArn: "arn:aws:elasticloadbalancing:ca-central-1:123456789012:targetgroup/push/abc"}},
+	}
+	for k, v := range event.Headers {
+		alb.Headers[k] = v
+	}
+
+	restData, err := json.Marshal(rest)
+	assert.Nil(t, err)
+	resp, err := handleEvent(context.TODO(), restData)
+	assert.Nil(t, err)
+	if r, ok := resp.(*events.APIGatewayProxyResponse); assert.True(t, ok) {
+		assert.Equal(t, 201, r.StatusCode)
+	}
+
+	hub.sent = nil
+	deliveryLedger = ledger.NewMemory(time.Hour)
+	albData, err := json.Marshal(alb)
+	assert.Nil(t, err)
+	resp, err = handleEvent(context.TODO(), albData)
+	assert.Nil(t, err)
+	if r, ok := resp.(*events.ALBTargetGroupResponse); assert.True(t, ok) {
+		assert.Equal(t, 201, r.StatusCode)
+		assert.Equal(t, "201 Created", r.StatusDescription)
+	}
+	assert.Equal(t, []string{"target1"}, hub.sent)
+}
+
+func TestHandleRequestRejectsInvalidNotificationsBeforeDelivery(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(`{"title":"not a mastodon notification"}`, "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Equal(t, 0, len(hub.sent))
+}
+
+func TestHandleRequestReportsRequestFailures(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	noAuth := keys.encryptedEvent(testMessage, "target1")
+	delete(noAuth.Headers, "authorization")
+	noVapidKey := keys.encryptedEvent(testMessage, "target1")
+	noVapidKey.Headers["crypto-key"] = strings.Split(noVapidKey.Headers["crypto-key"], ";")[0]
+	noSalt := keys.encryptedEvent(testMessage, "target1")
+	delete(noSalt.Headers, "encryption")
+	garbled := keys.encryptedEvent(testMessage, "target1")
+	garbled.Body = base64.StdEncoding.EncodeToString([]byte("not encrypted"))
+	badTarget := keys.encryptedEvent(testMessage, "target1")
+	badTarget.RawPath = "/!!!"
+	noTarget := keys.encryptedEvent(testMessage)
+
+	testCases := []struct {
+		event    events.LambdaFunctionURLRequest
+		expected int
+		desc     string
+	}{
+		{noAuth, 401, "missing jwt"},
+		{noVapidKey, 400, "missing vapid key"},
+		{noSalt, 400, "missing encryption header"},
+		{garbled, 400, "truncated payload"},
+		{badTarget, 404, "undecodable target"},
+		{noTarget, 404, "no targets"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp, err := handleRequest(context.TODO(), tc.event)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, resp.StatusCode)
+			assert.Equal(t, 0, len(hub.sent))
+		})
+	}
+}
+
+func TestHandleRequestReportsServerKeyFaultsAsServerErrors(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	event := keys.encryptedEvent(testMessage, "target1")
+
+	// a key rotated without updating the subscriptions
+	rotated := initTestEnv(t)
+	assert.NotEqual(t, keys.publicKey, rotated.publicKey)
+	resp, err := handleRequest(context.TODO(), event)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+
+	// the secret variables are cleared once parsed
+	os.Setenv("MSTDN_PRIVATE_KEY", base64.RawURLEncoding.EncodeToString(randomBytes(32)))
+	os.Setenv("MSTDN_SHARED_SECRET", "$*((")
+	cfg.ParseConfig()
+	resp, err = handleRequest(context.TODO(), event)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, 0, len(hub.sent))
+}
+
+func TestHandleRequestRejectsUnsupportedRequests(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	get := keys.encryptedEvent(testMessage, "target1")
+	get.RequestContext.HTTP.Method = "GET"
+	resp, err := handleRequest(context.TODO(), get)
+	assert.Nil(t, err)
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Headers["Allow"])
+
+	unsupported := keys.encryptedEvent(testMessage, "target1")
+	unsupported.Headers["content-encoding"] = "aes128gcm"
+	resp, err = handleRequest(context.TODO(), unsupported)
+	assert.Nil(t, err)
+	assert.Equal(t, 415, resp.StatusCode)
+	assert.Contains(t, resp.Body, "only aesgcm is supported")
+	assert.Equal(t, 0, len(hub.sent))
+}
+
+func TestHandleRequestEnforcesSourceAllowlist(t *testing.T) {
+	os.Setenv("MSTDN_ALLOW_CIDRS", "203.0.113.0/24")
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	outsider := keys.encryptedEvent(testMessage, "target1")
+	outsider.RequestContext.HTTP.SourceIP = "198.51.100.7"
+	resp, err := handleRequest(context.TODO(), outsider)
+	assert.Nil(t, err)
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Contains(t, resp.Body, "source ip")
+	assert.Equal(t, 0, len(hub.sent))
+
+	allowed := keys.encryptedEvent(testMessage, "target1")
+	allowed.RequestContext.HTTP.SourceIP = "203.0.113.9"
+	resp, err = handleRequest(context.TODO(), allowed)
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, []string{"target1"}, hub.sent)
+}
+
+func TestHandleRequestEnforcesSenderAllowlist(t *testing.T) {
+	vapid, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), vapid.X, vapid.Y))
+	os.Setenv("MSTDN_ALLOW_SENDERS", "mstdn.ca="+pinned)
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Contains(t, resp.Body, "mailto:admin@mstdn.example")
+	assert.Equal(t, 0, len(hub.sent))
+
+	os.Setenv("MSTDN_ALLOW_SENDERS", "mstdn.example="+pinned)
+	keys = initTestEnv(t)
+
+	// the request is signed with a key of its own choosing
+	forged := keys.encryptedEvent(testMessage, "target1")
+	resp, err = handleRequest(context.TODO(), forged)
+	assert.Nil(t, err)
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Contains(t, resp.Body, "pinned key")
+	assert.Equal(t, 0, len(hub.sent))
+
+	resp, err = handleRequest(context.TODO(), withVapidKey(keys.encryptedEvent(testMessage, "target1"), pinned))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, []string{"target1"}, hub.sent)
+}
+
+func TestHandleRequestRateLimitsSources(t *testing.T) {
+	os.Setenv("MSTDN_RATE_LIMIT", "0.001")
+	os.Setenv("MSTDN_RATE_BURST", "2")
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	fromIP := func(ip string, target string) events.LambdaFunctionURLRequest {
+		event := keys.encryptedEvent(testMessage, target)
+		event.RequestContext.HTTP.SourceIP = ip
+		return event
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := handleRequest(context.TODO(), fromIP("203.0.113.9", fmt.Sprintf("target%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+	resp, err := handleRequest(context.TODO(), fromIP("203.0.113.9", "target2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "30", resp.Headers["Retry-After"])
+	assert.Equal(t, 2, len(hub.sent))
+
+	// the bucket belongs to the source ip, not to the claimed sender
+	resp, err = handleRequest(context.TODO(), fromIP("198.51.100.7", "target3"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+}
+
+func TestHandleRequestRejectsForgedJwt(t *testing.T) {
+	os.Setenv("MSTDN_SKIP_JWT_VERIFY", "false")
+	keys := initTestEnv(t)
+	initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestHandleRequestReportsWorstTargetFailure(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	hub.errors["throttled"] = fmt.Errorf("[sns publish failed] %w", notify.ErrThrottled)
+	hub.errors["down"] = fmt.Errorf("[sns publish failed] %w", notify.ErrUnavailable)
+	hub.errors["missing"] = fmt.Errorf("[sns publish failed] %w", notify.ErrInvalidTarget)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "throttled", "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "30", resp.Headers["Retry-After"])
+
+	resp, err = handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "throttled", "down"))
+	assert.Nil(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "30", resp.Headers["Retry-After"])
+
+	resp, err = handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "missing", "down"))
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Empty(t, resp.Headers["Retry-After"])
+}
+
+func TestHandleRequestAppliesTargetFilters(t *testing.T) {
+	os.Setenv("MSTDN_TARGET_CONFIG", `{"bot":{"filter":"contains(['follow'], notification_type)"},"*":{"filter":"notification_type != 'poll'"}}`)
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "bot", "archive"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, []string{"archive"}, hub.sent)
+
+	hub.sent = nil
+	follow := strings.Replace(testMessage, `"notification_type":"mention"`, `"notification_type":"follow"`, 1)
+	resp, err = handleRequest(context.TODO(), keys.encryptedEvent(follow, "bot", "archive"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, []string{"bot", "archive"}, hub.sent)
+}
+
+func TestHandleRequestAppliesTargetTemplates(t *testing.T) {
+	os.Setenv("MSTDN_TARGET_CONFIG", `{"slack":{"template":"{{.Notification.Title}}: {{.Notification.Body}}"},"archive":{"template":"{\"instance\":{{json .Instance}},\"payload\":{{.Raw}}}"}}`)
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "slack", "archive", "bot"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "t: b", hub.messages["slack"])
+	assert.Equal(t, `{"instance":"mstdn.example","payload":`+testMessage+`}`, hub.messages["archive"])
+	assert.Equal(t, testMessage, hub.messages["bot"])
+}
+
+func TestHandleRequestWrapsEnvelopedTargets(t *testing.T) {
+	os.Setenv("MSTDN_TARGET_CONFIG", `{"archive":{"envelope":true},"slack":{"envelope":true,"template":"{{.Notification.Title}}"}}`)
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	event := keys.encryptedEvent(testMessage, "archive", "slack", "bot")
+	event.RequestContext.RequestID = "url-1"
+	ctx := lambdacontext.NewContext(context.TODO(), &lambdacontext.LambdaContext{AwsRequestID: "req-1"})
+	resp, err := handleRequest(ctx, event)
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, testMessage, hub.messages["bot"])
+
+	var env map[string]interface{}
+	if assert.Nil(t, json.Unmarshal([]byte(hub.messages["archive"]), &env)) {
+		assert.Equal(t, float64(envelope.Version), env["version"])
+		assert.Equal(t, "mstdn.example", env["instance"])
+		assert.Equal(t, envelope.SubscriptionID(event.RawPath), env["subscription_id"])
+		assert.Equal(t, "req-1", env["request_id"])
+		assert.Equal(t, "mailto:admin@mstdn.example", env["jwt_sub"])
+		assert.NotEmpty(t, env["jwt_exp"])
+		assert.NotEmpty(t, env["received_at"])
+		assert.Equal(t, "aesgcm", env["encoding"])
+		assert.Equal(t, "mention", env["payload"].(map[string]interface{})["notification_type"])
+	}
+	if assert.Nil(t, json.Unmarshal([]byte(hub.messages["slack"]), &env)) {
+		assert.Equal(t, "t", env["payload"])
+	}
+}
+
+func TestHandleRequestAppliesAccessTokenPolicies(t *testing.T) {
+	os.Setenv("MSTDN_TARGET_CONFIG", `{"slack":{"access_token":"drop","envelope":true},"bot":{"access_token":"keep"}}`)
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "slack", "bot"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.NotContains(t, hub.messages["slack"], "access_token")
+	assert.Contains(t, hub.messages["slack"], `"notification_type":"mention"`)
+	assert.Equal(t, testMessage, hub.messages["bot"])
+}
+
+func TestHandleRequestFailsTargetWhenTemplateFails(t *testing.T) {
+	os.Setenv("MSTDN_TARGET_CONFIG", `{"slack":{"template":"{{.Document.missing}}"}}`)
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "slack", "bot"))
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, []string{"bot"}, hub.sent)
+}
+
+func TestHandleRequestEnrichesNotifications(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	var path string
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`{"id":"1","type":"mention","status":{"id":"100"}}`))
+	}))
+	defer srv.Close()
+	enricher = enrich.NewEnricher(srv.Client(), srv.URL)
+	os.Setenv("MSTDN_TARGET_CONFIG", `{"*":{"filter":"notification.status.id == '100'"}}`)
+	var err error
+	targetRules, err = rules.New()
+	assert.Nil(t, err)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "/api/v1/notifications/1", path)
+	var doc map[string]interface{}
+	if assert.Nil(t, json.Unmarshal([]byte(hub.messages["target1"]), &doc)) {
+		assert.Equal(t, "tok", doc["access_token"])
+		assert.Equal(t, "1", doc["notification"].(map[string]interface{})["id"])
+	}
+}
+
+func TestHandleRequestEnrichesFromAllowlistedSendingInstance(t *testing.T) {
+	vapid, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), vapid.X, vapid.Y))
+	os.Setenv("MSTDN_ALLOW_SENDERS", "mstdn.example="+pinned)
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	var called string
+	enricher = enrich.NewEnricher(&nethttp.Client{Transport: roundTripper(func(r *nethttp.Request) (*nethttp.Response, error) {
+		called = r.URL.String()
+		return &nethttp.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(`{"id":"1","type":"mention"}`)), Header: nethttp.Header{}}, nil
+	})}, "")
+
+	resp, err := handleRequest(context.TODO(), withVapidKey(keys.encryptedEvent(testMessage, "target1"), pinned))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "https://mstdn.example/api/v1/notifications/1", called)
+	assert.Contains(t, hub.messages["target1"], `"notification":{"id":"1"`)
+}
+
+func TestHandleRequestForwardsAsReceivedWhenEnrichFails(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	srv := httptest.NewServer(nethttp.NotFoundHandler())
+	defer srv.Close()
+	enricher = enrich.NewEnricher(srv.Client(), srv.URL)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, testMessage, hub.messages["target1"])
+}
+
+func TestHandleRequestAttachesNotificationAttributes(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, map[string]string{
+		"notification_type":    "mention",
+		"preferred_locale":     "en",
+		"access_token_present": "true",
+		"instance":             "mstdn.example",
+	}, hub.attributes["target1"])
+}
+
+func TestHandleRequestPropagatesTraceContext(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	rec := tracetest.NewSpanRecorder()
+	orig := tracing.SetProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)), propagation.TraceContext{})
+	t.Cleanup(func() { tracing.SetProvider(orig, propagation.TraceContext{}) })
+
+	event := keys.encryptedEvent(testMessage, "target1")
+	event.Headers["traceparent"] = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := lambdacontext.NewContext(context.TODO(), &lambdacontext.LambdaContext{AwsRequestID: "req-1"})
+	resp, err := handleRequest(ctx, event)
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range rec.Ended() {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.SpanContext().TraceID().String())
+		spans[s.Name()] = s
+	}
+	for _, name := range []string{"request", "extract", "decrypt", "send"} {
+		assert.Contains(t, spans, name)
+	}
+	if req, ok := spans["request"]; ok {
+		assert.Contains(t, req.Attributes(), attribute.String("request_id", "req-1"))
+	}
+	if send, ok := spans["send"]; ok {
+		assert.Equal(t, spans["request"].SpanContext().SpanID(), send.Parent().SpanID())
+		assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+send.SpanContext().SpanID().String()+"-01", hub.attributes["target1"]["traceparent"])
+	}
+}
+
+func TestHandleRequestLogsWithInvocationFields(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	hub.failing["target1"] = true
+	var out bytes.Buffer
+	origOut := logging.SetOutput(&out)
+	t.Cleanup(func() { logging.SetOutput(origOut) })
+
+	for _, id := range []string{"req-1", "req-2"} {
+		out.Reset()
+		ctx := lambdacontext.NewContext(context.TODO(), &lambdacontext.LambdaContext{AwsRequestID: id})
+		resp, err := handleRequest(ctx, keys.encryptedEvent(testMessage, "target1"))
+		assert.Nil(t, err)
+		assert.Equal(t, 500, resp.StatusCode)
+
+		var failed map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			entry := make(map[string]interface{})
+			assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+			assert.Equal(t, id, entry["requestId"])
+			if entry["msg"] == "notification failed" {
+				failed = entry
+			}
+		}
+		if assert.NotNil(t, failed) {
+			assert.Equal(t, "mstdn.example", failed["instance"])
+			assert.Equal(t, "1", failed["notificationId"])
+			assert.Equal(t, "target1", failed["target"])
+		}
+	}
+}
+
+func TestHandleRequestRetryOnlyDeliversToFailedTargets(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	hub.failing["target2"] = true
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2", "target3"))
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, []string{"target1", "target2", "target3"}, hub.sent)
+
+	// Mastodon re-encrypts the notification on each retry
+	hub.sent = nil
+	delete(hub.failing, "target2")
+	resp, err = handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2", "target3"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, []string{"target2"}, hub.sent)
+}
+
+func TestHandleRequestEmitsMetrics(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	hub.failing["target2"] = true
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	counts := hub.counts()
+	assert.Equal(t, 1, counts[logging.MetricReceived])
+	assert.Equal(t, 1, counts[logging.MetricPublished])
+	assert.Equal(t, 1, counts[logging.MetricPublishFailed])
+	assert.Equal(t, 0, counts[logging.MetricDecryptFailed])
+	// jwt verify is skipped in tests; decrypt, parse, 2 publishes and the total
+	assert.Equal(t, 5, counts[logging.MetricLatency])
+
+	targets := make(map[string][]string)
+	for _, line := range strings.Split(strings.TrimSpace(hub.metrics.String()), "\n") {
+		rec := make(map[string]interface{})
+		if json.Unmarshal([]byte(line), &rec) != nil || rec[logging.PropTarget] == nil {
+			continue
+		}
+		target := rec[logging.PropTarget].(string)
+		for _, name := range []string{logging.MetricPublished, logging.MetricPublishFailed, logging.MetricLatency} {
+			if _, ok := rec[name]; ok {
+				targets[target] = append(targets[target], name)
+			}
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"target1": {logging.MetricLatency, logging.MetricPublished},
+		"target2": {logging.MetricLatency, logging.MetricPublishFailed},
+	}, targets)
+}
+
+func TestHandleRequestEmitsDecryptFailedMetric(t *testing.T) {
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	event := keys.encryptedEvent(testMessage, "target1")
+	event.Body = base64.StdEncoding.EncodeToString(randomBytes(64))
+	event.IsBase64Encoded = true
+	resp, err := handleRequest(context.TODO(), event)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	counts := hub.counts()
+	assert.Equal(t, 1, counts[logging.MetricReceived])
+	assert.Equal(t, 1, counts[logging.MetricDecryptFailed])
+	assert.Equal(t, 0, counts[logging.MetricPublished])
+}
+
+func TestHandleRequestDeadLettersWithAccessTokenPolicy(t *testing.T) {
+	os.Setenv("MSTDN_DEAD_LETTER_MAX_ATTEMPTS", "1")
+	os.Setenv("MSTDN_TARGET_CONFIG", `{"dropped":{"access_token":"drop"},"hashed":{"access_token":"hash"},"kept":{"access_token":"keep"}}`)
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	hub.failing["dropped"] = true
+	hub.failing["hashed"] = true
+	hub.failing["kept"] = true
+	queue := &testDeadLetterQueue{}
+	deadLetters = queue
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "dropped", "hashed", "kept"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	if assert.Equal(t, 3, len(queue.records)) {
+		for _, rec := range queue.records {
+			doc := make(map[string]interface{})
+			assert.Nil(t, json.Unmarshal([]byte(rec.Payload), &doc))
+			switch rec.Target {
+			case "dropped":
+				assert.NotContains(t, doc, "access_token")
+			case "kept":
+				// the record must be replayable to a target that needs the token
+				assert.Equal(t, "tok", doc["access_token"])
+			default:
+				assert.True(t, strings.HasPrefix(doc["access_token"].(string), payload.AccessTokenHashPrefix))
+			}
+		}
+	}
+}
+
+func TestHandleRequestDeadLettersTargetAfterMaxAttempts(t *testing.T) {
+	os.Setenv("MSTDN_DEAD_LETTER_MAX_ATTEMPTS", "2")
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	hub.failing["target2"] = true
+	queue := &testDeadLetterQueue{}
+	deadLetters = queue
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, 0, len(queue.records))
+
+	resp, err = handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	if assert.Equal(t, 1, len(queue.records)) {
+		rec := queue.records[0]
+		assert.Equal(t, "target2", rec.Target)
+		assert.Equal(t, testMessage, rec.Payload)
+		assert.Equal(t, 2, rec.Attempts)
+		assert.Contains(t, rec.Errors, "target unavailable")
+	}
+
+	hub.sent = nil
+	resp, err = handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, 0, len(hub.sent))
+}
+
+func TestHandleRequestDropsDuplicateNotificationIDs(t *testing.T) {
+	os.Setenv("MSTDN_DEDUP_WINDOW", "1h")
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	// same notification_id re-rendered with a different title
+	resent := strings.Replace(testMessage, `"title":"t"`, `"title":"t2"`, 1)
+	resp, err = handleRequest(context.TODO(), keys.encryptedEvent(resent, "target1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"target1"}, hub.sent)
+}
+
+func TestHandleRequestDoesNotDedupPartialDeliveries(t *testing.T) {
+	os.Setenv("MSTDN_DEDUP_WINDOW", "1h")
+	keys := initTestEnv(t)
+	hub := initTestHub(t)
+	hub.failing["target2"] = true
+
+	resp, err := handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+
+	delete(hub.failing, "target2")
+	resp, err = handleRequest(context.TODO(), keys.encryptedEvent(testMessage, "target1", "target2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "target2", hub.sent[len(hub.sent)-1])
+}
+
+func TestHandleRequestServesOperationalEndpoints(t *testing.T) {
+	initTestEnv(t)
+	hub := initTestHub(t)
+
+	get := func(path string, method string) *events.LambdaFunctionURLResponse {
+		event := events.LambdaFunctionURLRequest{RawPath: path}
+		event.RequestContext.HTTP.Method = method
+		resp, err := handleRequest(context.TODO(), event)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	resp := get("/_health", "GET")
+	assert.Equal(t, 200, resp.StatusCode)
+	var health ops.Health
+	assert.Nil(t, json.Unmarshal([]byte(resp.Body), &health))
+	assert.True(t, health.IsHealthy())
+
+	resp = get("/_version", "GET")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, resp.Body, "go_version")
+
+	assert.Equal(t, 404, get("/_selftest", "POST").StatusCode, "self test is disabled without a token")
+	assert.Equal(t, 404, get("/_unknown", "GET").StatusCode)
+	resp = get("/_health", "POST")
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET", resp.Headers["Allow"])
+	assert.Equal(t, 0, len(hub.sent))
+}
+
+func TestHandleRequestSelfTestRunsPipelineWithoutPublishing(t *testing.T) {
+	os.Setenv("MSTDN_SELFTEST_TOKEN", "s3cret")
+	os.Setenv("MSTDN_SKIP_JWT_VERIFY", "false")
+	os.Setenv("MSTDN_DEDUP_WINDOW", "1h")
+	os.Setenv("MSTDN_TARGET_CONFIG", `{"bot":{"filter":"notification_type == 'follow'"},"slack":{"template":"{{.Notification.Title}}","envelope":true}}`)
+	initTestEnv(t)
+	hub := initTestHub(t)
+
+	selfTest := func(token string, targets ...string) *events.LambdaFunctionURLResponse {
+		path := make([]string, len(targets))
+		for i, t := range targets {
+			path[i] = base64.RawURLEncoding.EncodeToString([]byte(t))
+		}
+		event := events.LambdaFunctionURLRequest{
+			RawPath: strings.Join(append([]string{"/_selftest"}, path...), "/"),
+			Headers: map[string]string{"authorization": "Bearer " + token},
+			RequestContext: events.LambdaFunctionURLRequestContext{
+				DomainName: "foo.lambda-url.ca-central-1.on.aws",
+				HTTP:       events.LambdaFunctionURLRequestContextHTTPDescription{Method: "POST"},
+			},
+		}
+		resp, err := handleRequest(context.TODO(), event)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	assert.Equal(t, 401, selfTest("wrong", "slack").StatusCode)
+
+	resp := selfTest("s3cret", "slack", "bot")
+	assert.Equal(t, 200, resp.StatusCode)
+	var result struct {
+		Status string      `json:"status"`
+		Stages []ops.Stage `json:"stages"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(resp.Body), &result))
+	assert.Equal(t, "ok", result.Status)
+	stages := make(map[string]ops.Stage)
+	for _, s := range result.Stages {
+		stages[s.Name] = s
+	}
+	for _, name := range []string{"jwt extract", "payload extract", "jwt verify", "payload decrypt", "notification parse", "targets extract", "render slack"} {
+		assert.Equal(t, ops.StageOK, stages[name].Status, name)
+	}
+	assert.Equal(t, ops.StageSkipped, stages["publish slack"].Status)
+	assert.Equal(t, "filtered out", stages["filter bot"].Detail)
+	assert.Equal(t, 0, len(hub.sent))
+
+	resp = selfTest("s3cret")
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Contains(t, resp.Body, "unknown target")
+}
+
+type testKeys struct {
+	publicKey    []byte
+	sharedSecret []byte
+}
+
+// initTestEnv configures the lambda with a freshly generated set of web push keys and returns them
+func initTestEnv(t *testing.T) *testKeys {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	secret := randomBytes(16)
+
+	os.Setenv("MSTDN_PRIVATE_KEY", base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))))
+	os.Setenv("MSTDN_SHARED_SECRET", base64.RawURLEncoding.EncodeToString(secret))
+	if _, ok := os.LookupEnv("MSTDN_SKIP_JWT_VERIFY"); !ok {
+		os.Setenv("MSTDN_SKIP_JWT_VERIFY", "true")
+	}
+	t.Cleanup(clearEnv)
+	cfg.ParseConfig()
+
+	return &testKeys{
+		publicKey:    elliptic.Marshal(elliptic.P256(), key.X, key.Y),
+		sharedSecret: secret,
+	}
+}
+
+// encryptedEvent encrypts msg the same way a Mastodon instance would and returns the resulting function URL event
+func (k *testKeys) encryptedEvent(msg string, targets ...string) events.LambdaFunctionURLRequest {
+	sender, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	senderPublic := elliptic.Marshal(elliptic.P256(), sender.X, sender.Y)
+	salt := randomBytes(16)
+
+	data, err := ece.Encrypt([]byte(msg),
+		ece.WithEncoding(ece.AESGCM),
+		ece.WithPrivate(sender.D.FillBytes(make([]byte, 32))),
+		ece.WithDh(k.publicKey),
+		ece.WithAuthSecret(k.sharedSecret),
+		ece.WithSalt(salt))
+	if err != nil {
+		panic(err)
+	}
+
+	path := make([]string, len(targets))
+	for i, t := range targets {
+		path[i] = base64.RawURLEncoding.EncodeToString([]byte(t))
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	return events.LambdaFunctionURLRequest{
+		RawPath:         "/" + strings.Join(path, "/"),
+		IsBase64Encoded: true,
+		Body:            base64.StdEncoding.EncodeToString(data),
+		Headers: map[string]string{
+			"authorization":    "WebPush " + testToken(),
+			"crypto-key":       fmt.Sprintf("dh=%s;p256ecdsa=%s", b64(senderPublic), b64(senderPublic)),
+			"encryption":       fmt.Sprintf("salt=%s", b64(salt)),
+			"content-encoding": "aesgcm",
+		},
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			DomainName: "foo.lambda-url.ca-central-1.on.aws",
+			HTTP:       events.LambdaFunctionURLRequestContextHTTPDescription{Method: "POST"},
+		},
+	}
+}
+
+type testHub struct {
+	sent       []string
+	messages   map[string]string
+	attributes map[string]map[string]string
+	failing    map[string]bool
+	errors     map[string]error
+	metrics    bytes.Buffer
+}
+
+// counts returns how many EMF records were emitted for each metric name
+func (h *testHub) counts() map[string]int {
+	counts := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(h.metrics.String()), "\n") {
+		rec := make(map[string]interface{})
+		if json.Unmarshal([]byte(line), &rec) != nil {
+			continue
+		}
+		for _, name := range []string{logging.MetricReceived, logging.MetricJwtFailed, logging.MetricDecryptFailed, logging.MetricPublished, logging.MetricPublishFailed, logging.MetricLatency} {
+			if _, ok := rec[name]; ok {
+				counts[name]++
+			}
+		}
+	}
+	return counts
+}
+
+type testNotifier struct {
+	target string
+	hub    *testHub
+}
+
+func (n *testNotifier) Send(ctx context.Context, msg *notify.Message) error {
+	n.hub.sent = append(n.hub.sent, n.target)
+	if n.hub.failing[n.target] {
+		return errors.New("target unavailable")
+	}
+	if err := n.hub.errors[n.target]; err != nil {
+		return err
+	}
+	n.hub.messages[n.target] = msg.Body
+	n.hub.attributes[n.target] = msg.Attributes
+	return nil
+}
+
+type testDeadLetterQueue struct {
+	records []*deadletter.Record
+}
+
+func (q *testDeadLetterQueue) Put(ctx context.Context, rec *deadletter.Record) error {
+	q.records = append(q.records, rec)
+	return nil
+}
+
+// initTestHub replaces the lambda's notifiers and stores with test doubles and loads the configured target rules for the duration of the test
+func initTestHub(t *testing.T) *testHub {
+	hub := &testHub{
+		messages:   make(map[string]string),
+		attributes: make(map[string]map[string]string),
+		failing:    make(map[string]bool),
+		errors:     make(map[string]error),
+	}
+	origNotifier, origLedger, origDeadLetters, origDedup, origRules, origEnricher, origLimiter := newNotifier, deliveryLedger, deadLetters, dedupStore, targetRules, enricher, limiter
+	newNotifier = func(target string) notify.Notifier {
+		return &testNotifier{target: target, hub: hub}
+	}
+	deliveryLedger = ledger.NewMemory(time.Hour)
+	dedupStore = dedup.NewMemory()
+	limiter = ratelimit.New()
+	origMetrics := logging.SetMetricsOutput(&hub.metrics)
+	var err error
+	if targetRules, err = rules.New(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		newNotifier, deliveryLedger, deadLetters, dedupStore, targetRules, enricher, limiter = origNotifier, origLedger, origDeadLetters, origDedup, origRules, origEnricher, origLimiter
+		logging.SetMetricsOutput(origMetrics)
+	})
+	return hub
+}
+
+// roundTripper answers the requests of an http client without a server
+type roundTripper func(*nethttp.Request) (*nethttp.Response, error)
+
+func (f roundTripper) RoundTrip(r *nethttp.Request) (*nethttp.Response, error) { return f(r) }
+
+// withVapidKey returns the event claiming to be signed with the given base64url encoded VAPID public key
+func withVapidKey(event events.LambdaFunctionURLRequest, key string) events.LambdaFunctionURLRequest {
+	dh := strings.Split(event.Headers["crypto-key"], ";")[0]
+	event.Headers["crypto-key"] = dh + ";p256ecdsa=" + key
+	return event
+}
+
+// testToken returns a JWT token with the claims a Mastodon instance would send; it is not signed with the VAPID key so verification must be skipped
+func testToken() string {
+	token := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, jwtlib.MapClaims{
+		"aud": "https://foo.lambda-url.ca-central-1.on.aws",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"sub": "mailto:admin@mstdn.example",
+	})
+	enc, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		panic(err)
+	}
+	return enc
+}
+
+func randomBytes(size int) []byte {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func clearEnv() {
+	for _, kv := range os.Environ() {
+		data := strings.SplitN(kv, "=", 2)
+		if strings.HasPrefix(data[0], "MSTDN_") {
+			os.Unsetenv(data[0])
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package allowlist
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The allowlist package restricts who may send push requests to the lambda.
+	Requests can be restricted by the source IP they were sent from
+	(MSTDN_ALLOW_CIDRS) and by the identity of the sender found in the JWT
+	subject (MSTDN_ALLOW_SENDERS); each restriction only applies when it is
+	configured. The JWT is verified with the key the request itself carries,
+	so anyone can sign a token with any subject; a sender is only trusted when
+	the request is signed with the VAPID key pinned for it.
+*/
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/jwt"
+)
+
+// ErrNotAllowed represents an error caused by a request from a source or sender that is not allowlisted
+var ErrNotAllowed = errors.New("not allowed")
+
+// CheckSource returns an error iff source CIDRs are configured and ip is not within any of them
+func CheckSource(ip string) error {
+	cidrs := cfg.Cfg.AllowedCIDRs()
+	if len(cidrs) == 0 {
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	if addr != nil {
+		for _, cidr := range cidrs {
+			if cidr.Contains(addr) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: source ip %q", ErrNotAllowed, ip)
+}
+
+// CheckSender returns the allowlist entry matching the JWT subject sub; an entry matches either the full subject (i.e. mailto:admin@mstdn.ca) or the instance domain of the subject (i.e. mstdn.ca), the full subject taking precedence. Returns an error iff senders are configured and none match or the request was not signed with the VAPID key pinned for the entry; the entry is empty if no senders are configured
+func CheckSender(sub string, key *ecdsa.PublicKey) (string, error) {
+	senders := cfg.Cfg.AllowedSenders()
+	if len(senders) == 0 {
+		return "", nil
+	}
+	entry := strings.ToLower(strings.TrimSpace(sub))
+	pinned, ok := senders[entry]
+	if !ok {
+		entry = jwt.SubjectDomain(entry)
+		pinned, ok = senders[entry]
+	}
+	if !ok || entry == "" {
+		return "", fmt.Errorf("%w: sender %q", ErrNotAllowed, sub)
+	}
+	if key == nil || !bytes.Equal(elliptic.Marshal(elliptic.P256(), key.X, key.Y), pinned) {
+		return "", fmt.Errorf("%w: sender %q did not sign with its pinned key", ErrNotAllowed, sub)
+	}
+	return entry, nil
+}
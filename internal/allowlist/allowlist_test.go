@@ -0,0 +1,145 @@
+package allowlist_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/slugger/mstdnlambda/internal/allowlist"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSourceAllowsEverythingWhenNotConfigured(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	cfg.ParseConfig()
+	assert.Nil(t, allowlist.CheckSource("198.51.100.7"))
+	assert.Nil(t, allowlist.CheckSource(""))
+}
+
+func TestCheckSource(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_ALLOW_CIDRS", "203.0.113.0/24, 2001:db8::/32")
+	cfg.ParseConfig()
+	testCases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"203.0.113.9", true},
+		{"2001:db8::1", true},
+		{"198.51.100.7", false},
+		{"", false},
+		{"not an ip", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.ip, func(t *testing.T) {
+			err := allowlist.CheckSource(tc.ip)
+			if tc.allowed {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, allowlist.ErrNotAllowed)
+			}
+		})
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	instanceKey, adminKey, otherKey := newKey(), newKey(), newKey()
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_ALLOW_SENDERS", "mstdn.ca="+encodeKey(instanceKey)+",mailto:Admin@example.com="+encodeKey(adminKey))
+	cfg.ParseConfig()
+	testCases := []struct {
+		sub   string
+		key   *ecdsa.PublicKey
+		entry string
+		desc  string
+	}{
+		{"mailto:admin@mstdn.ca", instanceKey, "mstdn.ca", "instance domain"},
+		{"mailto:other@MSTDN.ca", instanceKey, "mstdn.ca", "instance domain is case insensitive"},
+		{"https://mstdn.ca", instanceKey, "mstdn.ca", "https subject"},
+		{"mailto:admin@example.com", adminKey, "mailto:admin@example.com", "full subject"},
+		{"mailto:admin@mstdn.ca", otherKey, "", "forged subject"},
+		{"mailto:admin@example.com", instanceKey, "", "key pinned for another sender"},
+		{"mailto:admin@mstdn.ca", nil, "", "no key"},
+		{"mailto:other@example.com", adminKey, "", "other sender on allowlisted subject domain"},
+		{"mailto:admin@evil.example", otherKey, "", "unknown instance"},
+		{"", otherKey, "", "no subject"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			entry, err := allowlist.CheckSender(tc.sub, tc.key)
+			if tc.entry != "" {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, allowlist.ErrNotAllowed)
+			}
+			assert.Equal(t, tc.entry, entry)
+		})
+	}
+}
+
+func TestCheckSenderAllowsEverythingWhenNotConfigured(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	cfg.ParseConfig()
+	entry, err := allowlist.CheckSender("mailto:admin@evil.example", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", entry)
+}
+
+func TestParseConfigRequiresPinnedSenderKeys(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_ALLOW_SENDERS", "mstdn.ca")
+	assert.Panics(t, func() { cfg.ParseConfig() })
+
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_ALLOW_SENDERS", "mstdn.ca=bm90IGEga2V5")
+	assert.Panics(t, func() { cfg.ParseConfig() })
+}
+
+func TestParseConfigRejectsInvalidCIDRs(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_ALLOW_CIDRS", "203.0.113.9")
+	assert.Panics(t, func() { cfg.ParseConfig() })
+}
+
+func newKey() *ecdsa.PublicKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &key.PublicKey
+}
+
+func encodeKey(key *ecdsa.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+}
@@ -0,0 +1,52 @@
+package awssession
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/logging"
+)
+
+var sessions = make(map[string]*session.Session)
+var sessLock sync.Mutex
+
+// Get returns the shared AWS session for the lambda's configured region
+func Get() *session.Session {
+	return ForRegion(cfg.Cfg.AwsRegion())
+}
+
+// ForRegion returns the shared AWS session for the given region, creating it on first use
+func ForRegion(region string) *session.Session {
+	sessLock.Lock()
+	defer sessLock.Unlock()
+	sess, ok := sessions[region]
+	if !ok {
+		sess = session.Must(session.NewSessionWithOptions(session.Options{
+			Config: *aws.NewConfig().WithRegion(region),
+		}))
+		sessions[region] = sess
+		logging.GetLogForCategory(logging.DefaultCategory).WithField("awsregion", region).Debug("aws session initialized")
+	}
+	return sess
+}
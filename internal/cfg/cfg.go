@@ -19,7 +19,17 @@ package cfg
 	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
 */
 
-import "github.com/caarlos0/env/v6"
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+)
 
 // Config represents all config options for the lambda
 type Config interface {
@@ -29,8 +39,64 @@ type Config interface {
 	SharedSecret() string
 	IsSkipJwtVerify() bool
 	IsSkipPayloadDecrypt() bool
+	LedgerTable() string
+	LedgerTTL() time.Duration
+	DeadLetter() string
+	DeadLetterMaxAttempts() int
+	DedupTable() string
+	DedupWindow() time.Duration
+	Instance() string
+	FifoGroupBy() string
+	FifoGroupID() string
+	SnsRoles() map[string]string
+	OffloadBucket() string
+	OffloadPrefix() string
+	OffloadThreshold() int
+	TargetConfig() string
+	IsEnrichEnabled() bool
+	EnrichURL() string
+	EnrichTimeout() time.Duration
+	Audiences() []string
+	IsTrustForwardedHost() bool
+	MaxBodySize() int
+	SelfTestToken() string
+	AllowedCIDRs() []*net.IPNet
+	AllowedSenders() map[string][]byte
+	RateLimit() float64
+	RateBurst() int
+	RateLimitTable() string
+	IsMetricsEnabled() bool
+	MetricsNamespace() string
+	TraceExporter() string
+	LogLevels() map[string]string
+	LogFormat() string
+	LogSampleRate() float64
 }
 
+// Supported values for the MSTDN_FIFO_GROUP_BY setting
+const (
+	FifoGroupByAccount  = "account"
+	FifoGroupByType     = "type"
+	FifoGroupByConstant = "constant"
+)
+
+// Supported values for the MSTDN_LOG_FORMAT setting; the default is text in the dev environment and json otherwise
+const (
+	LogFormatDefault = ""
+	LogFormatJSON    = "json"
+	LogFormatText    = "text"
+)
+
+// Supported values for the MSTDN_TRACE_EXPORTER setting
+const (
+	TraceExporterNone = ""
+	TraceExporterOTLP = "otlp"
+	TraceExporterXRay = "xray"
+)
+
+// ErrInvalidConfig represents an error caused by a config setting with an unsupported value
+var ErrInvalidConfig = errors.New("invalid config")
+
 // Cfg is the global Config instance for the lambda
 var Cfg Config
 
@@ -49,22 +115,212 @@ func ParseConfig() Config {
 	if err := env.Parse(&cfg); err != nil {
 		panic(err)
 	}
+	if err := cfg.validate(); err != nil {
+		panic(err)
+	}
 	Cfg = &cfg
 	return Cfg
 }
 
 type configSettings struct {
-	AwsRegionValue     string `env:"MSTDN_AWS_REGION" envDefault:"ca-central-1"`
-	LogLevelValue      string `env:"MSTDN_LOG_LEVEL" envDefault:"INFO"`
-	PrivateKeyValue    string `env:"MSTDN_PRIVATE_KEY,notEmpty,unset"`
-	SharedSecretValue  string `env:"MSTDN_SHARED_SECRET,notEmpty,unset"`
-	SkipJwtVerify      bool   `env:"MSTDN_SKIP_JWT_VERIFY" envDefault:"false"`
-	SkipPayloadDecrypt bool   `env:"MSTDN_SKIP_PAYLOAD_DECRYPT" envDefault:"false"`
+	AwsRegionValue        string        `env:"MSTDN_AWS_REGION" envDefault:"ca-central-1"`
+	LogLevelValue         string        `env:"MSTDN_LOG_LEVEL" envDefault:"INFO"`
+	LogLevelsValue        []string      `env:"MSTDN_LOG_LEVELS"`
+	LogFormatValue        string        `env:"MSTDN_LOG_FORMAT"`
+	LogSampleRateValue    float64       `env:"MSTDN_LOG_SAMPLE_RATE" envDefault:"1"`
+	PrivateKeyValue       string        `env:"MSTDN_PRIVATE_KEY,notEmpty,unset"`
+	SharedSecretValue     string        `env:"MSTDN_SHARED_SECRET,notEmpty,unset"`
+	SkipJwtVerify         bool          `env:"MSTDN_SKIP_JWT_VERIFY" envDefault:"false"`
+	SkipPayloadDecrypt    bool          `env:"MSTDN_SKIP_PAYLOAD_DECRYPT" envDefault:"false"`
+	LedgerTableValue      string        `env:"MSTDN_LEDGER_TABLE"`
+	LedgerTTLValue        time.Duration `env:"MSTDN_LEDGER_TTL" envDefault:"24h"`
+	DeadLetterValue       string        `env:"MSTDN_DEAD_LETTER"`
+	DeadLetterAttempts    int           `env:"MSTDN_DEAD_LETTER_MAX_ATTEMPTS" envDefault:"5"`
+	DedupTableValue       string        `env:"MSTDN_DEDUP_TABLE"`
+	DedupWindowValue      time.Duration `env:"MSTDN_DEDUP_WINDOW" envDefault:"0s"`
+	InstanceValue         string        `env:"MSTDN_INSTANCE"`
+	FifoGroupByValue      string        `env:"MSTDN_FIFO_GROUP_BY" envDefault:"account"`
+	FifoGroupIDValue      string        `env:"MSTDN_FIFO_GROUP_ID" envDefault:"mstdnlambda"`
+	SnsRolesValue         []string      `env:"MSTDN_SNS_ROLES"`
+	OffloadValue          string        `env:"MSTDN_OFFLOAD"`
+	OffloadThresholdValue int           `env:"MSTDN_OFFLOAD_THRESHOLD" envDefault:"262144"`
+	TargetConfigValue     string        `env:"MSTDN_TARGET_CONFIG"`
+	Enrich                bool          `env:"MSTDN_ENRICH" envDefault:"false"`
+	EnrichURLValue        string        `env:"MSTDN_ENRICH_URL"`
+	EnrichTimeoutValue    time.Duration `env:"MSTDN_ENRICH_TIMEOUT" envDefault:"3s"`
+	AudiencesValue        []string      `env:"MSTDN_AUDIENCES"`
+	TrustForwardedHost    bool          `env:"MSTDN_TRUST_FORWARDED_HOST" envDefault:"false"`
+	MaxBodySizeValue      int           `env:"MSTDN_MAX_BODY_SIZE" envDefault:"8192"`
+	SelfTestTokenValue    string        `env:"MSTDN_SELFTEST_TOKEN,unset"`
+	AllowCIDRsValue       []string      `env:"MSTDN_ALLOW_CIDRS"`
+	AllowSendersValue     []string      `env:"MSTDN_ALLOW_SENDERS"`
+	RateLimitValue        float64       `env:"MSTDN_RATE_LIMIT" envDefault:"0"`
+	RateBurstValue        int           `env:"MSTDN_RATE_BURST" envDefault:"10"`
+	RateLimitTableValue   string        `env:"MSTDN_RATE_LIMIT_TABLE"`
+	Metrics               bool          `env:"MSTDN_METRICS" envDefault:"true"`
+	MetricsNamespaceValue string        `env:"MSTDN_METRICS_NAMESPACE" envDefault:"mstdnlambda"`
+	TraceExporterValue    string        `env:"MSTDN_TRACE_EXPORTER"`
+	snsRoles              map[string]string
+	logLevels             map[string]string
+	audiences             []string
+	allowedCIDRs          []*net.IPNet
+	allowedSenders        map[string][]byte
+	offloadBucket         string
+	offloadPrefix         string
+}
+
+func (c *configSettings) validate() error {
+	switch c.FifoGroupByValue {
+	case FifoGroupByAccount, FifoGroupByType, FifoGroupByConstant:
+	default:
+		return fmt.Errorf("%w: MSTDN_FIFO_GROUP_BY must be one of %s, %s or %s", ErrInvalidConfig, FifoGroupByAccount, FifoGroupByType, FifoGroupByConstant)
+	}
+
+	c.TraceExporterValue = strings.ToLower(strings.TrimSpace(c.TraceExporterValue))
+	switch c.TraceExporterValue {
+	case TraceExporterNone, TraceExporterOTLP, TraceExporterXRay:
+	default:
+		return fmt.Errorf("%w: MSTDN_TRACE_EXPORTER must be one of %s or %s", ErrInvalidConfig, TraceExporterOTLP, TraceExporterXRay)
+	}
+
+	if c.DeadLetterAttempts < 1 {
+		return fmt.Errorf("%w: MSTDN_DEAD_LETTER_MAX_ATTEMPTS must be at least 1", ErrInvalidConfig)
+	}
+
+	c.logLevels = make(map[string]string)
+	for _, v := range c.LogLevelsValue {
+		pair := strings.SplitN(v, "=", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" || strings.TrimSpace(pair[1]) == "" {
+			return fmt.Errorf("%w: MSTDN_LOG_LEVELS entry '%s' must be of the form category=level", ErrInvalidConfig, v)
+		}
+		c.logLevels[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+
+	c.LogFormatValue = strings.ToLower(strings.TrimSpace(c.LogFormatValue))
+	switch c.LogFormatValue {
+	case LogFormatDefault, LogFormatJSON, LogFormatText:
+	default:
+		return fmt.Errorf("%w: MSTDN_LOG_FORMAT must be one of %s or %s", ErrInvalidConfig, LogFormatJSON, LogFormatText)
+	}
+
+	if c.LogSampleRateValue < 0 || c.LogSampleRateValue > 1 {
+		return fmt.Errorf("%w: MSTDN_LOG_SAMPLE_RATE must be between 0 and 1", ErrInvalidConfig)
+	}
+
+	c.snsRoles = make(map[string]string)
+	for _, v := range c.SnsRolesValue {
+		pair := strings.SplitN(v, "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return fmt.Errorf("%w: MSTDN_SNS_ROLES entry '%s' must be of the form account=roleArn", ErrInvalidConfig, v)
+		}
+		c.snsRoles[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+
+	if c.MaxBodySizeValue <= 0 {
+		return fmt.Errorf("%w: MSTDN_MAX_BODY_SIZE must be a positive number of bytes", ErrInvalidConfig)
+	}
+
+	c.allowedCIDRs = nil
+	for _, v := range c.AllowCIDRsValue {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%w: MSTDN_ALLOW_CIDRS entry '%s' must be a CIDR, i.e. 203.0.113.0/24", ErrInvalidConfig, v)
+		}
+		c.allowedCIDRs = append(c.allowedCIDRs, ipnet)
+	}
+
+	c.allowedSenders = make(map[string][]byte)
+	for _, v := range c.AllowSendersValue {
+		pair := strings.SplitN(v, "=", 2)
+		sender := strings.ToLower(strings.TrimSpace(pair[0]))
+		if len(pair) != 2 || sender == "" {
+			return fmt.Errorf("%w: MSTDN_ALLOW_SENDERS entry '%s' must be of the form sender=vapidPublicKey", ErrInvalidConfig, v)
+		}
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(pair[1]), "="))
+		if err != nil || len(key) != 65 || key[0] != 4 {
+			return fmt.Errorf("%w: MSTDN_ALLOW_SENDERS entry '%s' must pin the sender's base64url encoded VAPID public key", ErrInvalidConfig, v)
+		}
+		c.allowedSenders[sender] = key
+	}
+
+	if c.RateLimitValue < 0 || c.RateBurstValue < 1 {
+		return fmt.Errorf("%w: MSTDN_RATE_LIMIT must not be negative and MSTDN_RATE_BURST must be at least 1", ErrInvalidConfig)
+	}
+
+	c.audiences = nil
+	for _, v := range c.AudiencesValue {
+		u, err := url.Parse(strings.TrimSpace(v))
+		if err != nil || u.Scheme != "https" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("%w: MSTDN_AUDIENCES entry '%s' must be an https origin, i.e. https://push.example.com", ErrInvalidConfig, v)
+		}
+		c.audiences = append(c.audiences, "https://"+strings.ToLower(u.Host))
+	}
+
+	if c.Enrich && c.EnrichURLValue == "" && c.InstanceValue == "" && !c.hasAllowedInstance() {
+		return fmt.Errorf("%w: MSTDN_ENRICH requires MSTDN_ENRICH_URL, MSTDN_INSTANCE or an instance domain in MSTDN_ALLOW_SENDERS; the API the access token is sent to is never taken from the request", ErrInvalidConfig)
+	}
+	if c.EnrichURLValue != "" {
+		if u, err := url.Parse(c.EnrichURLValue); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%w: MSTDN_ENRICH_URL must be an absolute url, i.e. https://mstdn.ca", ErrInvalidConfig)
+		}
+	}
+
+	if c.OffloadValue != "" {
+		u, err := url.Parse(c.OffloadValue)
+		if err != nil || u.Scheme != "s3" || u.Host == "" {
+			return fmt.Errorf("%w: MSTDN_OFFLOAD must be of the form s3://bucket/prefix", ErrInvalidConfig)
+		}
+		c.offloadBucket = u.Host
+		c.offloadPrefix = strings.TrimPrefix(u.Path, "/")
+	}
+	return nil
+}
+
+// hasAllowedInstance returns true iff MSTDN_ALLOW_SENDERS contains an instance domain entry, which names the instance's API
+func (c *configSettings) hasAllowedInstance() bool {
+	for sender := range c.allowedSenders {
+		if !strings.Contains(sender, ":") {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *configSettings) AwsRegion() string          { return c.AwsRegionValue }
-func (c *configSettings) IsSkipJwtVerify() bool      { return c.SkipJwtVerify }
-func (c *configSettings) IsSkipPayloadDecrypt() bool { return c.SkipPayloadDecrypt }
-func (c *configSettings) LogLevel() string           { return c.LogLevelValue }
-func (c *configSettings) PrivateKey() string         { return c.PrivateKeyValue }
-func (c *configSettings) SharedSecret() string       { return c.SharedSecretValue }
+func (c *configSettings) AllowedCIDRs() []*net.IPNet        { return c.allowedCIDRs }
+func (c *configSettings) AllowedSenders() map[string][]byte { return c.allowedSenders }
+func (c *configSettings) Audiences() []string               { return c.audiences }
+func (c *configSettings) AwsRegion() string                 { return c.AwsRegionValue }
+func (c *configSettings) DeadLetter() string                { return c.DeadLetterValue }
+func (c *configSettings) DeadLetterMaxAttempts() int        { return c.DeadLetterAttempts }
+func (c *configSettings) DedupTable() string                { return c.DedupTableValue }
+func (c *configSettings) DedupWindow() time.Duration        { return c.DedupWindowValue }
+func (c *configSettings) EnrichTimeout() time.Duration      { return c.EnrichTimeoutValue }
+func (c *configSettings) EnrichURL() string                 { return c.EnrichURLValue }
+func (c *configSettings) FifoGroupBy() string               { return c.FifoGroupByValue }
+func (c *configSettings) FifoGroupID() string               { return c.FifoGroupIDValue }
+func (c *configSettings) Instance() string                  { return c.InstanceValue }
+func (c *configSettings) IsEnrichEnabled() bool             { return c.Enrich }
+func (c *configSettings) IsMetricsEnabled() bool            { return c.Metrics }
+func (c *configSettings) IsSkipJwtVerify() bool             { return c.SkipJwtVerify }
+func (c *configSettings) IsSkipPayloadDecrypt() bool        { return c.SkipPayloadDecrypt }
+func (c *configSettings) IsTrustForwardedHost() bool        { return c.TrustForwardedHost }
+func (c *configSettings) LedgerTable() string               { return c.LedgerTableValue }
+func (c *configSettings) LedgerTTL() time.Duration          { return c.LedgerTTLValue }
+func (c *configSettings) LogFormat() string                 { return c.LogFormatValue }
+func (c *configSettings) LogLevel() string                  { return c.LogLevelValue }
+func (c *configSettings) LogLevels() map[string]string      { return c.logLevels }
+func (c *configSettings) LogSampleRate() float64            { return c.LogSampleRateValue }
+func (c *configSettings) MaxBodySize() int                  { return c.MaxBodySizeValue }
+func (c *configSettings) MetricsNamespace() string          { return c.MetricsNamespaceValue }
+func (c *configSettings) OffloadBucket() string             { return c.offloadBucket }
+func (c *configSettings) OffloadPrefix() string             { return c.offloadPrefix }
+func (c *configSettings) OffloadThreshold() int             { return c.OffloadThresholdValue }
+func (c *configSettings) PrivateKey() string                { return c.PrivateKeyValue }
+func (c *configSettings) SnsRoles() map[string]string       { return c.snsRoles }
+func (c *configSettings) RateBurst() int                    { return c.RateBurstValue }
+func (c *configSettings) RateLimit() float64                { return c.RateLimitValue }
+func (c *configSettings) RateLimitTable() string            { return c.RateLimitTableValue }
+func (c *configSettings) SelfTestToken() string             { return c.SelfTestTokenValue }
+func (c *configSettings) SharedSecret() string              { return c.SharedSecretValue }
+func (c *configSettings) TargetConfig() string              { return c.TargetConfigValue }
+func (c *configSettings) TraceExporter() string             { return c.TraceExporterValue }
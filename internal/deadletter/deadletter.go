@@ -0,0 +1,114 @@
+package deadletter
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The deadletter package stores notifications that could not be delivered to
+	a target after the configured number of attempts. Once a notification is
+	dead lettered the lambda reports success to Mastodon so it stops retrying;
+	the stored record holds everything needed to replay the delivery by hand.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/slugger/mstdnlambda/internal/awssession"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/devenv"
+)
+
+// ErrInvalidDestination represents an error caused by a dead letter destination that is not a supported SQS queue URL or S3 URL
+var ErrInvalidDestination = errors.New("invalid dead letter destination")
+
+// ErrDeadLetterFailure represents an error caused by a failure to store a record at the dead letter destination
+var ErrDeadLetterFailure = errors.New("dead letter failure")
+
+// Record is the document stored at the dead letter destination for each undeliverable notification
+type Record struct {
+	Fingerprint    string    `json:"fingerprint"`
+	Target         string    `json:"target"`
+	Payload        string    `json:"payload"`
+	Attempts       int       `json:"attempts"`
+	Errors         []string  `json:"errors"`
+	DeadLetteredAt time.Time `json:"deadLetteredAt"`
+}
+
+// NewRecord builds the Record for a notification that failed delivery to target; err is expanded into its full error chain. msg is stored as is so the delivery can be replayed, so it must already have the target's access_token policy applied
+func NewRecord(fingerprint string, target string, msg string, attempts int, err error) *Record {
+	return &Record{
+		Fingerprint:    fingerprint,
+		Target:         target,
+		Payload:        msg,
+		Attempts:       attempts,
+		Errors:         ErrorChain(err),
+		DeadLetteredAt: time.Now().UTC(),
+	}
+}
+
+// Queue defines the contract for a dead letter destination
+type Queue interface {
+	// Put stores the given record at the destination; returns nil on success or non-nil in case of an error
+	Put(ctx context.Context, rec *Record) error
+}
+
+// New returns the Queue for the configured dead letter destination; returns a nil Queue if dead lettering is not configured
+func New() (Queue, error) {
+	dest := cfg.Cfg.DeadLetter()
+	if dest == "" {
+		return nil, nil
+	}
+	if devenv.IsActive() {
+		return &devQueue{dest: dest}, nil
+	}
+	return Parse(dest)
+}
+
+// Parse returns the Queue for the given destination, which must either be an SQS queue URL or an S3 URL of the form s3://bucket/prefix
+func Parse(dest string) (Queue, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDestination, err.Error())
+	}
+
+	switch {
+	case u.Scheme == "s3" && u.Host != "":
+		return NewS3(s3.New(awssession.Get()), u.Host, strings.TrimPrefix(u.Path, "/")), nil
+	case u.Scheme == "https" && strings.HasPrefix(u.Host, "sqs."):
+		return NewSqs(sqs.New(awssession.Get()), dest), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDestination, dest)
+	}
+}
+
+// ErrorChain returns the message of err followed by the message of each error it wraps, outermost first
+func ErrorChain(err error) []string {
+	chain := make([]string, 0)
+	for ; err != nil; err = errors.Unwrap(err) {
+		chain = append(chain, err.Error())
+	}
+	return chain
+}
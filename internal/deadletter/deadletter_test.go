@@ -0,0 +1,138 @@
+package deadletter_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/deadletter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorChainListsWrappedErrorsOutermostFirst(t *testing.T) {
+	root := errors.New("throttled")
+	err := fmt.Errorf("[notification failed] %w", fmt.Errorf("[sns publish failed] %w", root))
+	assert.Equal(t, []string{
+		"[notification failed] [sns publish failed] throttled",
+		"[sns publish failed] throttled",
+		"throttled",
+	}, deadletter.ErrorChain(err))
+}
+
+func TestParseRejectsUnsupportedDestinations(t *testing.T) {
+	testCases := []struct {
+		dest string
+		desc string
+	}{
+		{"s3://", "s3 url without bucket"},
+		{"https://example.com/queue", "https url that is not sqs"},
+		{"arn:aws:sqs:ca-central-1:123456789012:dlq", "sqs arn"},
+		{"%%", "unparseable"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := deadletter.Parse(tc.dest)
+			assert.ErrorIs(t, err, deadletter.ErrInvalidDestination)
+		})
+	}
+}
+
+func TestSqsQueueSendsRecordAsJSON(t *testing.T) {
+	svc := &mockSqs{}
+	sut := deadletter.NewSqs(svc, "https://sqs.ca-central-1.amazonaws.com/123456789012/dlq")
+	rec := deadletter.NewRecord("fp", "target1", `{"foo":"bar","access_token":"s3cr3t"}`, 5, errors.New("boom"))
+	assert.Nil(t, sut.Put(context.Background(), rec))
+	if assert.NotNil(t, svc.input) {
+		assert.Equal(t, "https://sqs.ca-central-1.amazonaws.com/123456789012/dlq", *svc.input.QueueUrl)
+		var result deadletter.Record
+		assert.Nil(t, json.Unmarshal([]byte(*svc.input.MessageBody), &result))
+		assert.Equal(t, "target1", result.Target)
+		assert.Equal(t, `{"foo":"bar","access_token":"s3cr3t"}`, result.Payload)
+		assert.Equal(t, []string{"boom"}, result.Errors)
+	}
+}
+
+func TestSqsQueueWrapsSendFailures(t *testing.T) {
+	sut := deadletter.NewSqs(&mockSqs{err: errors.New("boom")}, "https://sqs.ca-central-1.amazonaws.com/123456789012/dlq")
+	err := sut.Put(context.Background(), deadletter.NewRecord("fp", "target1", "{}", 5, errors.New("boom")))
+	assert.ErrorIs(t, err, deadletter.ErrDeadLetterFailure)
+}
+
+func TestS3QueueWritesRecordUnderPrefix(t *testing.T) {
+	svc := &mockS3{}
+	sut := deadletter.NewS3(svc, "bucket", "dlq/")
+	rec := deadletter.NewRecord("fp", "target1", `{"foo":"bar"}`, 5, errors.New("boom"))
+	assert.Nil(t, sut.Put(context.Background(), rec))
+	if assert.NotNil(t, svc.input) {
+		assert.Equal(t, "bucket", *svc.input.Bucket)
+		assert.True(t, strings.HasPrefix(*svc.input.Key, "dlq/"+rec.DeadLetteredAt.Format("2006/01/02")+"/fp-"))
+		body, err := io.ReadAll(svc.input.Body)
+		assert.Nil(t, err)
+		assert.Contains(t, string(body), `"target":"target1"`)
+	}
+}
+
+func TestParseConfigRejectsInvalidMaxAttempts(t *testing.T) {
+	for _, attempts := range []string{"0", "-1"} {
+		t.Setenv("MSTDN_PRIVATE_KEY", "key")
+		t.Setenv("MSTDN_SHARED_SECRET", "secret")
+		t.Setenv("MSTDN_DEAD_LETTER_MAX_ATTEMPTS", attempts)
+		assert.Panics(t, func() { cfg.ParseConfig() }, attempts)
+	}
+
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_DEAD_LETTER_MAX_ATTEMPTS", "1")
+	cfg.ParseConfig()
+	assert.Equal(t, 1, cfg.Cfg.DeadLetterMaxAttempts())
+}
+
+type mockSqs struct {
+	sqsiface.SQSAPI
+	input *sqs.SendMessageInput
+	err   error
+}
+
+func (m *mockSqs) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	m.input = input
+	return &sqs.SendMessageOutput{}, m.err
+}
+
+type mockS3 struct {
+	s3iface.S3API
+	input *s3.PutObjectInput
+}
+
+func (m *mockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	m.input = input
+	return &s3.PutObjectOutput{}, nil
+}
@@ -0,0 +1,113 @@
+package deadletter
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/sirupsen/logrus"
+	"github.com/slugger/mstdnlambda/internal/logging"
+)
+
+type sqsQueue struct {
+	queueURL string
+	svc      sqsiface.SQSAPI
+}
+
+// NewSqs returns a Queue that sends each record as a JSON message to the given SQS queue
+func NewSqs(svc sqsiface.SQSAPI, queueURL string) Queue {
+	return &sqsQueue{
+		queueURL: queueURL,
+		svc:      svc,
+	}
+}
+
+func (q *sqsQueue) Put(ctx context.Context, rec *Record) error {
+	enc, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("[record marshal failed] %w: %s", ErrDeadLetterFailure, err.Error())
+	}
+	if _, err = q.svc.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.queueURL),
+		MessageBody: aws.String(string(enc)),
+	}); err != nil {
+		return fmt.Errorf("[sqs send failed] %w: %s", ErrDeadLetterFailure, err.Error())
+	}
+	logging.GetLogForContext(ctx, logging.DeadLetterCategory).WithField("queue", q.queueURL).Debug("record sent")
+	return nil
+}
+
+type s3Queue struct {
+	bucket string
+	prefix string
+	svc    s3iface.S3API
+}
+
+// NewS3 returns a Queue that writes each record as a JSON object in the given bucket under prefix
+func NewS3(svc s3iface.S3API, bucket string, prefix string) Queue {
+	return &s3Queue{
+		bucket: bucket,
+		prefix: prefix,
+		svc:    svc,
+	}
+}
+
+func (q *s3Queue) Put(ctx context.Context, rec *Record) error {
+	enc, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("[record marshal failed] %w: %s", ErrDeadLetterFailure, err.Error())
+	}
+	key := q.key(rec)
+	if _, err = q.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(q.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(enc),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return fmt.Errorf("[s3 put failed] %w: %s", ErrDeadLetterFailure, err.Error())
+	}
+	logging.GetLogForContext(ctx, logging.DeadLetterCategory).WithField("key", key).Debug("record written")
+	return nil
+}
+
+// key partitions records by day; the target is hashed since topic ARNs contain characters that are awkward in object keys
+func (q *s3Queue) key(rec *Record) string {
+	target := sha256.Sum256([]byte(rec.Target))
+	return fmt.Sprintf("%s%s/%s-%s.json", q.prefix, rec.DeadLetteredAt.Format("2006/01/02"), rec.Fingerprint, hex.EncodeToString(target[:8]))
+}
+
+type devQueue struct {
+	dest string
+}
+
+func (q *devQueue) Put(ctx context.Context, rec *Record) error {
+	logging.LogAsJSON(logging.GetLogForContext(ctx, logging.DevEnvCategory).WithField("dest", q.dest), logrus.InfoLevel, rec, "dead lettered", false)
+	return nil
+}
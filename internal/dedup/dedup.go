@@ -0,0 +1,62 @@
+package dedup
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The dedup package drops repeated deliveries of the same Mastodon
+	notification. A notification is identified by its payload.Notification Key,
+	which combines the notification_id with the access token it was sent for, so
+	the same ID received for different accounts or instances is never mistaken
+	for a duplicate. Keys are remembered in a pluggable Store for a configurable
+	window.
+*/
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/devenv"
+)
+
+// ErrStoreFailure represents an error caused by a failure reading from or writing to the backing store of a Store
+var ErrStoreFailure = errors.New("dedup store failure")
+
+// Store defines the contract for remembering which notifications have already been delivered
+type Store interface {
+	// Seen returns true if key was recorded and its window has not yet elapsed
+	Seen(ctx context.Context, key string) (bool, error)
+	// Record remembers key for the given window
+	Record(ctx context.Context, key string, window time.Duration) error
+}
+
+// IsEnabled returns true if deduplication is configured for the lambda
+func IsEnabled() bool {
+	return cfg.Cfg.DedupWindow() > 0
+}
+
+// New returns the Store implementation selected by the lambda configuration; a DynamoDB table is used when one is configured otherwise keys are only remembered in memory
+func New() Store {
+	if devenv.IsActive() || cfg.Cfg.DedupTable() == "" {
+		return NewMemory()
+	}
+	return newDynamo(cfg.Cfg.DedupTable())
+}
@@ -0,0 +1,115 @@
+package dedup_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/slugger/mstdnlambda/internal/dedup"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreRemembersKeysForWindow(t *testing.T) {
+	sut := dedup.NewMemory()
+	seen, err := sut.Seen(context.Background(), "key")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+
+	assert.Nil(t, sut.Record(context.Background(), "key", time.Hour))
+	seen, err = sut.Seen(context.Background(), "key")
+	assert.Nil(t, err)
+	assert.True(t, seen)
+
+	assert.Nil(t, sut.Record(context.Background(), "expired", 0))
+	seen, err = sut.Seen(context.Background(), "expired")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+}
+
+func TestDynamoStoreSeen(t *testing.T) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	testCases := []struct {
+		item     map[string]*dynamodb.AttributeValue
+		expected bool
+		desc     string
+	}{
+		{nil, false, "key not found"},
+		{map[string]*dynamodb.AttributeValue{"expires": {N: aws.String(future)}}, true, "key within window"},
+		{map[string]*dynamodb.AttributeValue{"expires": {N: aws.String(past)}}, false, "key expired but not yet removed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sut := dedup.NewDynamo(&mockDynamo{item: tc.item}, "dedup")
+			seen, err := sut.Seen(context.Background(), "key")
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, seen)
+		})
+	}
+}
+
+func TestDynamoStoreRecordWritesExpiry(t *testing.T) {
+	svc := &mockDynamo{}
+	sut := dedup.NewDynamo(svc, "dedup")
+	assert.Nil(t, sut.Record(context.Background(), "key", time.Hour))
+	if assert.NotNil(t, svc.put) {
+		assert.Equal(t, "key", *svc.put.Item["id"].S)
+		expires, err := strconv.ParseInt(*svc.put.Item["expires"].N, 10, 64)
+		assert.Nil(t, err)
+		assert.Greater(t, expires, time.Now().Unix())
+	}
+}
+
+func TestDynamoStoreWrapsStoreFailures(t *testing.T) {
+	sut := dedup.NewDynamo(&mockDynamo{err: errors.New("boom")}, "dedup")
+	_, err := sut.Seen(context.Background(), "key")
+	assert.ErrorIs(t, err, dedup.ErrStoreFailure)
+	assert.ErrorIs(t, sut.Record(context.Background(), "key", time.Hour), dedup.ErrStoreFailure)
+}
+
+type mockDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	item map[string]*dynamodb.AttributeValue
+	put  *dynamodb.PutItemInput
+	err  error
+}
+
+func (m *mockDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &dynamodb.GetItemOutput{Item: m.item}, nil
+}
+
+func (m *mockDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.put = input
+	return &dynamodb.PutItemOutput{}, nil
+}
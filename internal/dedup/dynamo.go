@@ -0,0 +1,93 @@
+package dedup
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/slugger/mstdnlambda/internal/awssession"
+	"github.com/slugger/mstdnlambda/internal/logging"
+)
+
+// DynamoDB attribute names used by the dedup table; the table must use id as its partition key
+const (
+	idAttr      = "id"
+	expiresAttr = "expires"
+)
+
+type dynamoStore struct {
+	table string
+	svc   dynamodbiface.DynamoDBAPI
+}
+
+func newDynamo(table string) Store {
+	return NewDynamo(dynamodb.New(awssession.Get()), table)
+}
+
+// NewDynamo returns a Store backed by the given DynamoDB table; keys are written with an expires attribute suitable for use as the table's TTL attribute
+func NewDynamo(svc dynamodbiface.DynamoDBAPI, table string) Store {
+	return &dynamoStore{
+		table: table,
+		svc:   svc,
+	}
+}
+
+func (s *dynamoStore) Seen(ctx context.Context, key string) (bool, error) {
+	resp, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{idAttr: {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("[dedup get failed] %w: %s", ErrStoreFailure, err.Error())
+	}
+
+	// DynamoDB removes expired items lazily so the expiry must be checked here too
+	attr, ok := resp.Item[expiresAttr]
+	if !ok || attr.N == nil {
+		return false, nil
+	}
+	expires, err := strconv.ParseInt(*attr.N, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("[dedup expiry parse failed] %w: %s", ErrStoreFailure, err.Error())
+	}
+	return time.Now().Unix() < expires, nil
+}
+
+func (s *dynamoStore) Record(ctx context.Context, key string, window time.Duration) error {
+	_, err := s.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			idAttr:      {S: aws.String(key)},
+			expiresAttr: {N: aws.String(strconv.FormatInt(time.Now().Add(window).Unix(), 10))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("[dedup put failed] %w: %s", ErrStoreFailure, err.Error())
+	}
+	logging.GetLogForContext(ctx, logging.DedupCategory).WithField("key", key).Debug("notification recorded")
+	return nil
+}
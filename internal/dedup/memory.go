@@ -0,0 +1,58 @@
+package dedup
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	keys map[string]time.Time
+	lock sync.Mutex
+}
+
+// NewMemory returns a Store that only remembers keys for the life of the process
+func NewMemory() Store {
+	return &memoryStore{
+		keys: make(map[string]time.Time),
+	}
+}
+
+func (s *memoryStore) Seen(ctx context.Context, key string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expires, ok := s.keys[key]
+	return ok && time.Now().Before(expires), nil
+}
+
+func (s *memoryStore) Record(ctx context.Context, key string, window time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for k, expires := range s.keys {
+		if !now.Before(expires) {
+			delete(s.keys, k)
+		}
+	}
+	s.keys[key] = now.Add(window)
+	return nil
+}
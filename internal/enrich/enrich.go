@@ -0,0 +1,147 @@
+package enrich
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The enrich package fetches the full notification from the Mastodon API
+	using the notification_id and access_token found in a push notification.
+	The push notification only carries a short summary; the API returns the
+	complete notification including the account and status it refers to. The
+	full notification is added to the forwarded push notification under the
+	"notification" key, so subscribers no longer have to call the API
+	themselves. Since the access token is sent to the API, the API is either
+	configured or the instance of the allowlisted sender whose pinned key
+	signed the request; it is never taken from anything else in the request.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/logging"
+	"github.com/slugger/mstdnlambda/internal/payload"
+)
+
+// NotificationKey is the key the full notification is added under
+const NotificationKey = "notification"
+
+// maxResponseSize caps the size of the API response that is read
+const maxResponseSize = 1 << 20
+
+// ErrEnrichFailure represents an error caused by a failure fetching the full notification from the Mastodon API
+var ErrEnrichFailure = errors.New("enrich failure")
+
+// Enricher adds the full notification from the Mastodon API to push notifications
+type Enricher struct {
+	client  *http.Client
+	baseURL string
+}
+
+// New returns the Enricher configured for the lambda; nil is returned if enrichment is disabled. The API called is MSTDN_ENRICH_URL, else the one of MSTDN_INSTANCE, else the one of the allowlisted sending instance
+func New() *Enricher {
+	if !cfg.Cfg.IsEnrichEnabled() {
+		return nil
+	}
+	baseURL := cfg.Cfg.EnrichURL()
+	if baseURL == "" && cfg.Cfg.Instance() != "" {
+		baseURL = "https://" + cfg.Cfg.Instance()
+	}
+	return NewEnricher(&http.Client{Timeout: cfg.Cfg.EnrichTimeout()}, baseURL)
+}
+
+// NewEnricher returns an Enricher using client to call the Mastodon API at baseURL; if baseURL is empty, the API of the allowlisted sending instance is called
+func NewEnricher(client *http.Client, baseURL string) *Enricher {
+	return &Enricher{
+		client:  client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Enrich returns msg with the full notification added; sender is the allowlist entry the request was verified against
+func (e *Enricher) Enrich(ctx context.Context, msg string, n *payload.Notification, sender string) (string, error) {
+	full, err := e.fetch(ctx, n, sender)
+	if err != nil {
+		return "", err
+	}
+
+	var doc map[string]json.RawMessage
+	if err = json.Unmarshal([]byte(msg), &doc); err != nil {
+		return "", fmt.Errorf("[notification unmarshal failed] %w: %s", ErrEnrichFailure, err.Error())
+	}
+	doc[NotificationKey] = full
+	enc, err := json.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("[notification marshal failed] %w: %s", ErrEnrichFailure, err.Error())
+	}
+	return string(enc), nil
+}
+
+// apiURL returns the base URL of the API to call for a request from sender; only an instance domain entry of the sender allowlist names an API, a full subject entry (i.e. mailto:admin@mstdn.ca) does not
+func (e *Enricher) apiURL(sender string) (string, error) {
+	if e.baseURL != "" {
+		return e.baseURL, nil
+	}
+	if _, ok := cfg.Cfg.AllowedSenders()[sender]; !ok || sender == "" || strings.Contains(sender, ":") {
+		return "", fmt.Errorf("[api unknown] %w: sender %q is not an allowlisted instance", ErrEnrichFailure, sender)
+	}
+	return "https://" + sender, nil
+}
+
+func (e *Enricher) fetch(ctx context.Context, n *payload.Notification, sender string) (json.RawMessage, error) {
+	baseURL, err := e.apiURL(sender)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := baseURL + "/api/v1/notifications/" + url.PathEscape(string(n.NotificationID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("[request create failed] %w: %s", ErrEnrichFailure, err.Error())
+	}
+	req.Header.Set("Authorization", "Bearer "+n.AccessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("[api request failed] %w: %s", ErrEnrichFailure, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[api request failed] %w: %s returned %d", ErrEnrichFailure, endpoint, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("[api response read failed] %w: %s", ErrEnrichFailure, err.Error())
+	}
+	var obj map[string]json.RawMessage
+	if err = json.Unmarshal(body, &obj); err != nil {
+		return nil, fmt.Errorf("[api response unmarshal failed] %w: %s", ErrEnrichFailure, err.Error())
+	}
+	logging.GetLogForContext(ctx, logging.EnrichCategory).WithField("endpoint", endpoint).Debug("notification fetched")
+	return json.RawMessage(body), nil
+}
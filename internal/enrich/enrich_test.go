@@ -0,0 +1,163 @@
+package enrich_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/enrich"
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/stretchr/testify/assert"
+)
+
+const testNotification = `{"access_token":"tok","notification_id":42,"notification_type":"mention","title":"t"}`
+
+const fullNotification = `{"id":"42","type":"mention","account":{"id":"1","acct":"foo"},"status":{"id":"100","content":"<p>hi</p>"}}`
+
+func TestEnrichAddsFullNotification(t *testing.T) {
+	var auth, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		path = r.URL.Path
+		w.Write([]byte(fullNotification))
+	}))
+	defer srv.Close()
+
+	sut := enrich.NewEnricher(srv.Client(), srv.URL+"/")
+	result, err := sut.Enrich(context.Background(), testNotification, parse(t), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer tok", auth)
+	assert.Equal(t, "/api/v1/notifications/42", path)
+
+	var doc map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(result), &doc))
+	assert.Equal(t, "mention", doc["notification_type"])
+	full := doc[enrich.NotificationKey].(map[string]interface{})
+	assert.Equal(t, "foo", full["account"].(map[string]interface{})["acct"])
+	assert.Equal(t, "100", full["status"].(map[string]interface{})["id"])
+}
+
+func TestEnrichFailures(t *testing.T) {
+	testCases := []struct {
+		status int
+		body   string
+		desc   string
+	}{
+		{http.StatusNotFound, `{"error":"Record not found"}`, "notification dismissed"},
+		{http.StatusUnauthorized, `{"error":"The access token is invalid"}`, "token revoked"},
+		{http.StatusOK, "<html></html>", "not json"},
+		{http.StatusOK, "[]", "not an object"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			_, err := enrich.NewEnricher(srv.Client(), srv.URL).Enrich(context.Background(), testNotification, parse(t), "")
+			assert.ErrorIs(t, err, enrich.ErrEnrichFailure)
+		})
+	}
+}
+
+func TestEnrichRequiresConfiguredAPI(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_ENRICH", "true")
+	// the access token must never be sent to a host taken from the request
+	assert.Panics(t, func() { cfg.ParseConfig() })
+
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_INSTANCE", "mstdn.ca")
+	cfg.ParseConfig()
+	assert.NotNil(t, enrich.New())
+}
+
+func TestEnrichCallsAllowlistedSendingInstance(t *testing.T) {
+	pinned := base64.RawURLEncoding.EncodeToString(newKey(t))
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_ENRICH", "true")
+	t.Setenv("MSTDN_ALLOW_SENDERS", "mstdn.ca="+pinned+",mailto:admin@example.com="+pinned)
+	cfg.ParseConfig()
+
+	var called []string
+	client := &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+		called = append(called, r.URL.String())
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(fullNotification)), Header: http.Header{}}, nil
+	})}
+	sut := enrich.NewEnricher(client, "")
+
+	_, err := sut.Enrich(context.Background(), testNotification, parse(t), "mstdn.ca")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://mstdn.ca/api/v1/notifications/42"}, called)
+
+	// the access token is never sent to a host that is not an allowlisted instance
+	for _, sender := range []string{"mailto:admin@example.com", "evil.example", ""} {
+		_, err = sut.Enrich(context.Background(), testNotification, parse(t), sender)
+		assert.ErrorIs(t, err, enrich.ErrEnrichFailure, sender)
+	}
+	assert.Equal(t, 1, len(called))
+}
+
+func TestEnrichRequiresAllowlistedInstanceWithoutConfiguredAPI(t *testing.T) {
+	pinned := base64.RawURLEncoding.EncodeToString(newKey(t))
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_ENRICH", "true")
+	t.Setenv("MSTDN_ALLOW_SENDERS", "mailto:admin@example.com="+pinned)
+	assert.Panics(t, func() { cfg.ParseConfig() })
+}
+
+// roundTripper answers the requests of an http client without a server
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func newKey(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+}
+
+func parse(t *testing.T) *payload.Notification {
+	n, err := payload.Parse(testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,115 @@
+package envelope
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The envelope package wraps a delivered notification with metadata about
+	where and when it was received so subscribers can audit its origin and
+	correlate it with the gateway logs. The envelope is versioned; fields are
+	only ever added within a version and Version is bumped on any change that
+	would break existing consumers.
+
+	Version 1:
+	{
+		"version": 1,
+		"received_at": "2022-12-25T10:30:00.123Z",
+		"instance": "mstdn.ca",
+		"subscription_id": "<sha256 of the request path>",
+		"request_id": "<lambda request id>",
+		"jwt_sub": "mailto:admin@mstdn.ca",
+		"jwt_exp": "2022-12-26T10:30:00Z",
+		"encoding": "aesgcm",
+		"payload": {...}
+	}
+
+	The payload is embedded as JSON if the delivered body is valid JSON,
+	otherwise it is embedded as a JSON string.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version is the version of the envelope schema produced by this package
+const Version = 1
+
+// Metadata describes the request a notification was received in
+type Metadata struct {
+	ReceivedAt     time.Time
+	Instance       string
+	SubscriptionID string
+	RequestID      string
+	JwtSub         string
+	JwtExp         time.Time
+	Encoding       string
+}
+
+type envelope struct {
+	Version        int             `json:"version"`
+	ReceivedAt     time.Time       `json:"received_at"`
+	Instance       string          `json:"instance"`
+	SubscriptionID string          `json:"subscription_id"`
+	RequestID      string          `json:"request_id"`
+	JwtSub         string          `json:"jwt_sub"`
+	JwtExp         *time.Time      `json:"jwt_exp"`
+	Encoding       string          `json:"encoding"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// SubscriptionID identifies the Mastodon push subscription a request was made for; each subscription is registered with its own endpoint path so the path is hashed rather than exposed
+func SubscriptionID(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:])
+}
+
+// Wrap returns body wrapped in an envelope carrying meta
+func Wrap(meta *Metadata, body string) (string, error) {
+	env := envelope{
+		Version:        Version,
+		ReceivedAt:     meta.ReceivedAt.UTC(),
+		Instance:       meta.Instance,
+		SubscriptionID: meta.SubscriptionID,
+		RequestID:      meta.RequestID,
+		JwtSub:         meta.JwtSub,
+		Encoding:       meta.Encoding,
+		Payload:        json.RawMessage(body),
+	}
+	if !meta.JwtExp.IsZero() {
+		exp := meta.JwtExp.UTC()
+		env.JwtExp = &exp
+	}
+	if !json.Valid([]byte(body)) {
+		enc, err := json.Marshal(body)
+		if err != nil {
+			return "", fmt.Errorf("[payload marshal failed] %w", err)
+		}
+		env.Payload = enc
+	}
+
+	enc, err := json.Marshal(env)
+	if err != nil {
+		return "", fmt.Errorf("[envelope marshal failed] %w", err)
+	}
+	return string(enc), nil
+}
@@ -0,0 +1,70 @@
+package envelope_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/slugger/mstdnlambda/internal/envelope"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapEmbedsJSONPayload(t *testing.T) {
+	meta := &envelope.Metadata{
+		ReceivedAt:     time.Date(2022, 12, 25, 5, 30, 0, 0, time.FixedZone("EST", -5*3600)),
+		Instance:       "mstdn.ca",
+		SubscriptionID: envelope.SubscriptionID("/abc/def"),
+		RequestID:      "req-1",
+		JwtSub:         "mailto:admin@mstdn.ca",
+		JwtExp:         time.Date(2022, 12, 26, 10, 30, 0, 0, time.UTC),
+		Encoding:       "aesgcm",
+	}
+	result, err := envelope.Wrap(meta, `{"title":"foo"}`)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"received_at": "2022-12-25T10:30:00Z",
+		"instance": "mstdn.ca",
+		"subscription_id": "`+envelope.SubscriptionID("/abc/def")+`",
+		"request_id": "req-1",
+		"jwt_sub": "mailto:admin@mstdn.ca",
+		"jwt_exp": "2022-12-26T10:30:00Z",
+		"encoding": "aesgcm",
+		"payload": {"title": "foo"}
+	}`, result)
+}
+
+func TestWrapEmbedsTextPayloadAsString(t *testing.T) {
+	result, err := envelope.Wrap(&envelope.Metadata{ReceivedAt: time.Now()}, "foo: bar")
+	assert.Nil(t, err)
+
+	var decoded map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(result), &decoded))
+	assert.Equal(t, "foo: bar", decoded["payload"])
+	assert.Nil(t, decoded["jwt_exp"])
+	assert.Contains(t, decoded, "request_id")
+}
+
+func TestSubscriptionIDDependsOnPath(t *testing.T) {
+	assert.Equal(t, envelope.SubscriptionID("/abc"), envelope.SubscriptionID("/abc"))
+	assert.NotEqual(t, envelope.SubscriptionID("/abc"), envelope.SubscriptionID("/abc/def"))
+}
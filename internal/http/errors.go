@@ -0,0 +1,140 @@
+package http
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/slugger/mstdnlambda/internal/allowlist"
+	"github.com/slugger/mstdnlambda/internal/notify"
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/slugger/mstdnlambda/internal/ratelimit"
+)
+
+// ErrUnknownTarget represents an error caused by a request that does not resolve to any deliverable target
+var ErrUnknownTarget = errors.New("unknown target")
+
+// ErrTooLarge represents an error caused by a request body that exceeds the accepted size
+var ErrTooLarge = errors.New("request too large")
+
+// RetryAfter is the delay advertised to the sender when a downstream service is throttling or unavailable
+const RetryAfter = 30 * time.Second
+
+// Error attaches the HTTP status of the response reporting an error to it; used where the status depends on the stage that failed rather than on the error itself
+type Error struct {
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// WithStatus returns err annotated with the given HTTP status
+func WithStatus(status int, err error) error {
+	return &Error{Status: status, Err: err}
+}
+
+// statusBySentinel maps the known error sentinels to the HTTP status reporting them; Mastodon drops the subscription on any 4xx but 408 and 429 so only errors that are certainly caused by the request may be reported as such. A payload that cannot be decrypted is not one of them since a wrong or rotated server key fails the same way
+var statusBySentinel = []struct {
+	err    error
+	status int
+}{
+	{ErrTooLarge, http.StatusRequestEntityTooLarge},
+	{allowlist.ErrNotAllowed, http.StatusForbidden},
+	{ratelimit.ErrRateLimited, http.StatusTooManyRequests},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed},
+	{ErrUnsupportedEncoding, http.StatusUnsupportedMediaType},
+	{ErrUnsupportedContentType, http.StatusUnsupportedMediaType},
+	{ErrTargetDecode, http.StatusNotFound},
+	{ErrUnknownTarget, http.StatusNotFound},
+	{notify.ErrThrottled, http.StatusTooManyRequests},
+	{notify.ErrUnavailable, http.StatusServiceUnavailable},
+	{ErrInvalidHeader, http.StatusBadRequest},
+	{ErrMissingHeader, http.StatusBadRequest},
+	{ErrInvalidInput, http.StatusBadRequest},
+	{ErrNotBase64Encoded, http.StatusBadRequest},
+	{ErrCryptoFailure, http.StatusBadRequest},
+	{payload.ErrInvalidNotification, http.StatusBadRequest},
+}
+
+// StatusCode returns the HTTP status of the response reporting err; anything not known to be caused by the request or a downstream service is a server fault
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Status
+	}
+	for _, s := range statusBySentinel {
+		if errors.Is(err, s.err) {
+			return s.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// EncodeError generates the event response reporting err; errors caused by the request are described in the response so the sender can diagnose them, anything else is only logged
+func EncodeError(err error) *events.LambdaFunctionURLResponse {
+	code := StatusCode(err)
+	body := map[string]string{"status": statusText(code)}
+	if code < http.StatusInternalServerError && code != http.StatusTooManyRequests {
+		body["error"] = err.Error()
+	}
+	resp := EncodeJSON(code, body)
+	if code == http.StatusMethodNotAllowed {
+		resp.Headers = map[string]string{"Allow": PushMethod}
+	}
+	return resp
+}
+
+// retryHeaders returns the headers telling the sender when to retry a response with the given status; nil if the status does not call for a delayed retry
+func retryHeaders(code int) map[string]string {
+	if code != http.StatusTooManyRequests && code != http.StatusServiceUnavailable {
+		return nil
+	}
+	return map[string]string{"Retry-After": strconv.Itoa(int(RetryAfter.Seconds()))}
+}
+
+func statusText(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "bad request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "unknown target"
+	case http.StatusMethodNotAllowed:
+		return "method not allowed"
+	case http.StatusRequestEntityTooLarge:
+		return "too large"
+	case http.StatusUnsupportedMediaType:
+		return "unsupported media type"
+	case http.StatusTooManyRequests:
+		return "throttled"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	default:
+		return "fail"
+	}
+}
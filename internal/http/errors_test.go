@@ -0,0 +1,85 @@
+package http
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/slugger/mstdnlambda/internal/allowlist"
+	"github.com/slugger/mstdnlambda/internal/notify"
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/slugger/mstdnlambda/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusCode(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected int
+		desc     string
+	}{
+		{fmt.Errorf("[payload extract failed] %w", ErrMissingHeader), 400, "missing header"},
+		{fmt.Errorf("[payload decrypt failed] %w", payload.ErrDecryptFailure), 500, "decrypt failure"},
+		{fmt.Errorf("[notification parse failed] %w", payload.ErrInvalidNotification), 400, "invalid notification"},
+		{WithStatus(401, fmt.Errorf("[jwt extract failed] %w", ErrMissingHeader)), 401, "explicit status wins"},
+		{fmt.Errorf("[targets extract failed] %w", ErrTargetDecode), 404, "undecodable target"},
+		{fmt.Errorf("[notification failed] %w", notify.ErrInvalidTarget), 500, "invalid target"},
+		{ErrTooLarge, 413, "too large"},
+		{fmt.Errorf("[source check failed] %w", allowlist.ErrNotAllowed), 403, "not allowlisted"},
+		{fmt.Errorf("[rate limit exceeded] %w", ratelimit.ErrRateLimited), 429, "rate limited"},
+		{fmt.Errorf("[request check failed] %w", ErrMethodNotAllowed), 405, "method not allowed"},
+		{fmt.Errorf("[request check failed] %w", ErrUnsupportedEncoding), 415, "unsupported encoding"},
+		{fmt.Errorf("[notification failed] %w", notify.ErrThrottled), 429, "throttled"},
+		{fmt.Errorf("[notification failed] %w", notify.ErrUnavailable), 503, "unavailable"},
+		{errors.New("boom"), 500, "unknown"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, StatusCode(tc.err))
+		})
+	}
+}
+
+func TestEncodeErrorAddsRetryAfter(t *testing.T) {
+	resp := EncodeError(notify.ErrThrottled)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "30", resp.Headers["Retry-After"])
+
+	resp = EncodeError(ErrInvalidHeader)
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Empty(t, resp.Headers)
+}
+
+func TestEncodeErrorDescribesRequestErrors(t *testing.T) {
+	resp := EncodeError(fmt.Errorf("[request check failed] %w: aes128gcm", ErrUnsupportedEncoding))
+	assert.Equal(t, 415, resp.StatusCode)
+	assert.JSONEq(t, `{"status":"unsupported media type","error":"[request check failed] unsupported content encoding: aes128gcm"}`, resp.Body)
+
+	resp = EncodeError(ErrMethodNotAllowed)
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Headers["Allow"])
+
+	resp = EncodeError(errors.New("dynamodb credentials expired"))
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.JSONEq(t, `{"status":"fail"}`, resp.Body)
+}
@@ -23,6 +23,7 @@ import (
 	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -50,17 +51,52 @@ var ErrNotBase64Encoded = errors.New("input is not base64 encoded")
 // ErrTargetDecode represents an error caused by a target in the request path that could not be decoded (usually not base64 encoded)
 var ErrTargetDecode = errors.New("target decode failed")
 
-// ExtractJwt Parses the given lambda event and extracts the JWT token details from the request
-func ExtractJwt(event events.LambdaFunctionURLRequest) (*jwt.VerifiableJwt, error) {
-	var token, aud string
+// ErrMethodNotAllowed represents an error caused by a push request that was not sent with the POST method
+var ErrMethodNotAllowed = errors.New("method not allowed")
+
+// ErrUnsupportedEncoding represents an error caused by a push request whose content is not encoded with a supported scheme
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// ErrUnsupportedContentType represents an error caused by a push request whose content type is not a web push message
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// PushMethod is the HTTP method push requests must be sent with
+const PushMethod = "POST"
+
+// pushContentType is the content type of a web push message; the content type is optional
+const pushContentType = "application/octet-stream"
+
+// CheckRequest checks that the given request is a web push request this lambda can process: it must be POSTed with a supported Content-Encoding and, if a Content-Type is set, it must be application/octet-stream
+func CheckRequest(event *Request) error {
+	if event.Method != "" && !strings.EqualFold(event.Method, PushMethod) {
+		return fmt.Errorf("%w: %s", ErrMethodNotAllowed, event.Method)
+	}
+
+	enc := strings.TrimSpace(event.Headers[contentEncodingHeaderName])
+	if enc == "" {
+		return fmt.Errorf("%w: %s", ErrMissingHeader, contentEncodingHeaderName)
+	}
+	if !strings.EqualFold(enc, payload.Encoding) {
+		return fmt.Errorf("%w: %s; only %s is supported", ErrUnsupportedEncoding, enc, payload.Encoding)
+	}
+
+	if ct := event.Headers[contentTypeHeaderName]; ct != "" {
+		if mediaType := strings.TrimSpace(strings.Split(ct, ";")[0]); !strings.EqualFold(mediaType, pushContentType) {
+			return fmt.Errorf("%w: %s; expected %s", ErrUnsupportedContentType, ct, pushContentType)
+		}
+	}
+	return nil
+}
+
+// ExtractJwt Parses the given request and extracts the JWT token details from the request; a missing or invalid authorization header is reported as unauthorized
+func ExtractJwt(event *Request) (*jwt.VerifiableJwt, error) {
+	var token string
 	var err error
 
 	if token, err = extractBearerToken(event); err != nil {
-		return nil, err
+		return nil, WithStatus(http.StatusUnauthorized, err)
 	}
 
-	aud = fmt.Sprintf("https://%s", event.RequestContext.DomainName)
-
 	publicKey, err := parseP256PublicKey(event)
 	if err != nil {
 		return nil, err
@@ -68,36 +104,42 @@ func ExtractJwt(event events.LambdaFunctionURLRequest) (*jwt.VerifiableJwt, erro
 
 	return &jwt.VerifiableJwt{
 		Token:     token,
-		Aud:       aud,
+		Aud:       audiences(event),
 		PublicKey: publicKey,
 	}, nil
 }
 
-// ExtractPayload Parses the lambda event and extracts the aesgcm encrypted payload; the payload is NOT decrypted by this function
-func ExtractPayload(event events.LambdaFunctionURLRequest) (*payload.EncryptedPayload, error) {
+// ExtractPayload Parses the request and extracts the aesgcm encrypted payload; the payload is NOT decrypted by this function
+func ExtractPayload(event *Request) (*payload.EncryptedPayload, error) {
 	if !event.IsBase64Encoded {
 		return nil, ErrNotBase64Encoded // AWS will not send raw binary streams to us
 	}
 
+	if max := cfg.Cfg.MaxBodySize(); len(event.Body) > b64.StdEncoding.EncodedLen(max) {
+		return nil, fmt.Errorf("%w: body exceeds %d bytes", ErrTooLarge, max)
+	}
+
 	var sharedSecret, myPrivateKey, theirPublicKey, salt, data []byte
+	var rs uint32
 	var err error
 
 	if theirPublicKey, err = parseTheirPublicKey(event); err != nil {
 		return nil, err
 	}
 
-	if salt, err = parseSalt(event); err != nil {
+	if salt, rs, err = parseEncryption(event); err != nil {
 		return nil, err
 	}
 
+	// the keys are configured for the lambda so failing to decode them is a server fault; any 4xx would make Mastodon drop the subscription
 	if sharedSecret, err = b64.RawURLEncoding.DecodeString(cfg.Cfg.SharedSecret()); err != nil {
 		e := fmt.Errorf("[shared secret decode failed] %w: %s", ErrNotBase64Encoded, err.Error())
-		return nil, e
+		return nil, WithStatus(http.StatusInternalServerError, e)
 	}
 
 	if myPrivateKey, err = b64.RawURLEncoding.DecodeString(cfg.Cfg.PrivateKey()); err != nil {
 		e := fmt.Errorf("[private key decode failed] %w: %s", ErrNotBase64Encoded, err.Error())
-		return nil, e
+		return nil, WithStatus(http.StatusInternalServerError, e)
 	}
 
 	if data, err = b64.StdEncoding.DecodeString(event.Body); err != nil {
@@ -105,18 +147,27 @@ func ExtractPayload(event events.LambdaFunctionURLRequest) (*payload.EncryptedPa
 		return nil, e
 	}
 
+	if len(data) > cfg.Cfg.MaxBodySize() {
+		return nil, fmt.Errorf("%w: body exceeds %d bytes", ErrTooLarge, cfg.Cfg.MaxBodySize())
+	}
+
+	if err = checkRecord(data, rs); err != nil {
+		return nil, err
+	}
+
 	return &payload.EncryptedPayload{
 		SharedSecret:   sharedSecret,
 		MyPrivateKey:   myPrivateKey,
 		TheirPublicKey: theirPublicKey,
 		Salt:           salt,
+		RecordSize:     rs,
 		Data:           data,
 	}, nil
 }
 
-// ExtractTargets parses the given lambda event and decodes the targets from the request path
-func ExtractTargets(event events.LambdaFunctionURLRequest) ([]string, error) {
-	encodedTargets := strings.Split(event.RawPath, "/")
+// ExtractTargets parses the given request and decodes the targets from the request path
+func ExtractTargets(event *Request) ([]string, error) {
+	encodedTargets := strings.Split(event.Path, "/")
 	targets := make([]string, 0)
 	for _, t := range encodedTargets {
 		if t == "" {
@@ -131,17 +182,22 @@ func ExtractTargets(event events.LambdaFunctionURLRequest) ([]string, error) {
 	return targets, nil
 }
 
-// EncodeResponse generates an event response using the given HTTP status code and message
+// EncodeResponse generates an event response using the given HTTP status code and message; throttling and unavailable responses advertise when to retry
 func EncodeResponse(code int, msg string) *events.LambdaFunctionURLResponse {
-	resp := map[string]string{
+	return EncodeJSON(code, map[string]string{
 		"status": msg,
-	}
-	enc, err := json.Marshal(resp)
+	})
+}
+
+// EncodeJSON generates an event response using the given HTTP status code with the JSON encoding of body as the response body
+func EncodeJSON(code int, body interface{}) *events.LambdaFunctionURLResponse {
+	enc, err := json.Marshal(body)
 	if err != nil {
 		panic(err)
 	}
 	return &events.LambdaFunctionURLResponse{
 		StatusCode:      code,
+		Headers:         retryHeaders(code),
 		Body:            string(enc),
 		IsBase64Encoded: false,
 	}
@@ -47,26 +47,99 @@ func TestExtractJwtSucceeds(t *testing.T) {
 			DomainName: expectedDomainName,
 		},
 	}
-	result, err := http.ExtractJwt(req)
+	result, err := http.ExtractJwt(http.FromFunctionURL(req))
 	assert.Nil(t, err)
 	assert.Equal(t, "MyToken", result.Token)
 	assert.Equal(t, pubkeyBytes, elliptic.Marshal(elliptic.P256(), result.PublicKey.X, result.PublicKey.Y))
-	assert.Equal(t, fmt.Sprintf("https://%s", expectedDomainName), result.Aud)
+	assert.Equal(t, []string{fmt.Sprintf("https://%s", expectedDomainName)}, result.Aud)
+}
+
+func TestExtractJwtAudiences(t *testing.T) {
+	pubkey := genP256PublicKey()
+	headers := map[string]string{
+		"authorization":    "WebPush MyToken",
+		"crypto-key":       b64UrlEncodeKeyValBytes("p256ecdsa", elliptic.Marshal(elliptic.P256(), pubkey.X, pubkey.Y)),
+		"x-forwarded-host": "Push.Example.com, cdn.example.net",
+	}
+	testCases := []struct {
+		env      map[string]string
+		expected []string
+		desc     string
+	}{
+		{map[string]string{}, []string{"https://foo.lambda-url.ca-central-1.on.aws"}, "derived from domain name"},
+		{map[string]string{"MSTDN_AUDIENCES": "https://push.example.com/,https://Other.example.com"}, []string{"https://push.example.com", "https://other.example.com"}, "configured audiences"},
+		{map[string]string{"MSTDN_TRUST_FORWARDED_HOST": "true"}, []string{"https://foo.lambda-url.ca-central-1.on.aws", "https://push.example.com"}, "forwarded host trusted"},
+		{map[string]string{"MSTDN_AUDIENCES": "https://push.example.com", "MSTDN_TRUST_FORWARDED_HOST": "true"}, []string{"https://push.example.com"}, "configured audiences and forwarded host"},
+	}
+
+	orig := cfg.Cfg
+	defer func() { cfg.Cfg = orig }()
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			initEnv(envValues{privateKey: "key", sharedSecret: "secret"})
+			for k, v := range tc.env {
+				os.Setenv(k, v)
+			}
+			defer clearEnv()
+			cfg.ParseConfig()
+
+			req := events.LambdaFunctionURLRequest{
+				Headers:        headers,
+				RequestContext: events.LambdaFunctionURLRequestContext{DomainName: "foo.lambda-url.ca-central-1.on.aws"},
+			}
+			result, err := http.ExtractJwt(http.FromFunctionURL(req))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, result.Aud)
+		})
+	}
+}
+
+func TestExtractJwtIgnoresForwardedHostByDefault(t *testing.T) {
+	orig := cfg.Cfg
+	defer func() { cfg.Cfg = orig }()
+	initEnv(envValues{privateKey: "key", sharedSecret: "secret"})
+	defer clearEnv()
+	cfg.ParseConfig()
+
+	pubkey := genP256PublicKey()
+	req := events.LambdaFunctionURLRequest{
+		Headers: map[string]string{
+			"authorization":    "WebPush MyToken",
+			"crypto-key":       b64UrlEncodeKeyValBytes("p256ecdsa", elliptic.Marshal(elliptic.P256(), pubkey.X, pubkey.Y)),
+			"x-forwarded-host": "evil.example.com",
+		},
+		RequestContext: events.LambdaFunctionURLRequestContext{DomainName: "foo.com"},
+	}
+	result, err := http.ExtractJwt(http.FromFunctionURL(req))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://foo.com"}, result.Aud)
+}
+
+func TestParseConfigRejectsInvalidAudiences(t *testing.T) {
+	orig := cfg.Cfg
+	defer func() { cfg.Cfg = orig }()
+	for _, aud := range []string{"push.example.com", "http://push.example.com", "https://push.example.com/path"} {
+		initEnv(envValues{privateKey: "key", sharedSecret: "secret"})
+		os.Setenv("MSTDN_AUDIENCES", aud)
+		assert.Panics(t, func() { cfg.ParseConfig() }, aud)
+		clearEnv()
+	}
 }
 
 func TestExtractJwtFailsWhenPublicKeyIsNotBase64Encoded(t *testing.T) {
 	req := events.LambdaFunctionURLRequest{
 		Headers: map[string]string{"authorization": "WebPush MyToken", "crypto-key": "p256ecdsa=(##)"},
 	}
-	_, err := http.ExtractJwt(req)
+	_, err := http.ExtractJwt(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrNotBase64Encoded)
+	assert.Equal(t, 400, http.StatusCode(err))
 }
 
 func TestExtractJwtFailsWhenPublicKeyIsInvalid(t *testing.T) {
 	req := events.LambdaFunctionURLRequest{
 		Headers: map[string]string{"authorization": "WebPush MyToken", "crypto-key": "foobar"},
 	}
-	_, err := http.ExtractJwt(req)
+	_, err := http.ExtractJwt(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrInvalidHeader)
 	assert.ErrorContains(t, err, "invalid key/val header: [foobar]")
 }
@@ -75,7 +148,7 @@ func TestExtractJwtFailsWhenPublicKeyIsMissing(t *testing.T) {
 	req := events.LambdaFunctionURLRequest{
 		Headers: map[string]string{"authorization": "WebPush MyToken"},
 	}
-	_, err := http.ExtractJwt(req)
+	_, err := http.ExtractJwt(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrMissingHeader)
 	assert.ErrorContains(t, err, "crypto-key")
 }
@@ -84,9 +157,10 @@ func TestExtractJwtFailsWhenBearerTokenIsMissing(t *testing.T) {
 	req := events.LambdaFunctionURLRequest{
 		Headers: map[string]string{},
 	}
-	_, err := http.ExtractJwt(req)
+	_, err := http.ExtractJwt(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrMissingHeader)
 	assert.ErrorContains(t, err, "authorization")
+	assert.Equal(t, 401, http.StatusCode(err))
 }
 
 func TestExtractJwtFailsWhenBearerTokenIsInvalid(t *testing.T) {
@@ -103,16 +177,17 @@ func TestExtractJwtFailsWhenBearerTokenIsInvalid(t *testing.T) {
 			req := events.LambdaFunctionURLRequest{
 				Headers: map[string]string{"authorization": tc.hdrVal},
 			}
-			_, err := http.ExtractJwt(req)
+			_, err := http.ExtractJwt(http.FromFunctionURL(req))
 			assert.ErrorIs(t, err, http.ErrInvalidHeader)
+			assert.Equal(t, 401, http.StatusCode(err))
 		})
 	}
 }
 
 func TestExtractPayloadSucceeds(t *testing.T) {
-	expectedSalt := "ValidSalt"
+	expectedSalt := "ValidSalt16Bytes"
 	expectedCryptoKey := "ValidCryptoKey"
-	expectedBody := "ValidBody"
+	expectedBody := "ValidBodyAtLeastOneRecordLong!"
 	expectedPrivateKey := "ValidPrivateKey"
 	expectedSharedSecret := "ValidSharedSecret"
 
@@ -129,7 +204,7 @@ func TestExtractPayloadSucceeds(t *testing.T) {
 		Body:            b64StdEncode(expectedBody),
 	}
 
-	result, err := http.ExtractPayload(req)
+	result, err := http.ExtractPayload(http.FromFunctionURL(req))
 	assert.Nil(t, err)
 	assert.Equal(t, expectedBody, string(result.Data))
 	assert.Equal(t, expectedSalt, string(result.Salt))
@@ -138,6 +213,42 @@ func TestExtractPayloadSucceeds(t *testing.T) {
 	assert.Equal(t, expectedSharedSecret, string(result.SharedSecret))
 }
 
+func TestExtractPayloadEnforcesSizeLimits(t *testing.T) {
+	initEnv(envValues{
+		privateKey:   b64UrlEncode("valid key"),
+		sharedSecret: b64UrlEncode("valid secret"),
+	})
+	os.Setenv("MSTDN_MAX_BODY_SIZE", "30")
+	defer clearEnv()
+	cfg.ParseConfig()
+
+	headers := map[string]string{"encryption": b64UrlEncodeKeyVal("salt", "0123456789abcdef"), "crypto-key": b64UrlEncodeKeyVal("dh", "foobar")}
+	testCases := []struct {
+		body        string
+		expectedErr error
+		desc        string
+	}{
+		{strings.Repeat("x", 33), http.ErrTooLarge, "body over limit"},
+		{strings.Repeat("x", 15), http.ErrInvalidInput, "body shorter than a record"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := events.LambdaFunctionURLRequest{IsBase64Encoded: true, Headers: headers, Body: b64StdEncode(tc.body)}
+			_, err := http.ExtractPayload(http.FromFunctionURL(req))
+			assert.ErrorIs(t, err, tc.expectedErr)
+		})
+	}
+
+	req := events.LambdaFunctionURLRequest{IsBase64Encoded: true, Headers: headers, Body: b64StdEncode(strings.Repeat("x", 30))}
+	_, err := http.ExtractPayload(http.FromFunctionURL(req))
+	assert.Nil(t, err)
+
+	headers["encryption"] += ";rs=3"
+	_, err = http.ExtractPayload(http.FromFunctionURL(req))
+	assert.ErrorIs(t, err, http.ErrInvalidInput)
+}
+
 func TestExtractPayloadFailsIfBodyIsInvalid(t *testing.T) {
 	initEnv(envValues{
 		privateKey:   b64UrlEncode("valid key"),
@@ -148,10 +259,10 @@ func TestExtractPayloadFailsIfBodyIsInvalid(t *testing.T) {
 
 	req := events.LambdaFunctionURLRequest{
 		IsBase64Encoded: true,
-		Headers:         map[string]string{"encryption": b64UrlEncodeKeyVal("salt", "foobar"), "crypto-key": b64UrlEncodeKeyVal("dh", "foobar")},
+		Headers:         map[string]string{"encryption": b64UrlEncodeKeyVal("salt", "0123456789abcdef"), "crypto-key": b64UrlEncodeKeyVal("dh", "foobar")},
 		Body:            "**$(#", // invalid
 	}
-	_, err := http.ExtractPayload(req)
+	_, err := http.ExtractPayload(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrNotBase64Encoded)
 	assert.ErrorContains(t, err, "[body decode failed]")
 }
@@ -166,11 +277,12 @@ func TestExtractPayloadFailsIfPrivateKeyIsInvalid(t *testing.T) {
 
 	req := events.LambdaFunctionURLRequest{
 		IsBase64Encoded: true,
-		Headers:         map[string]string{"encryption": b64UrlEncodeKeyVal("salt", "foobar"), "crypto-key": b64UrlEncodeKeyVal("dh", "foobar")},
+		Headers:         map[string]string{"encryption": b64UrlEncodeKeyVal("salt", "0123456789abcdef"), "crypto-key": b64UrlEncodeKeyVal("dh", "foobar")},
 	}
-	_, err := http.ExtractPayload(req)
+	_, err := http.ExtractPayload(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrNotBase64Encoded)
 	assert.ErrorContains(t, err, "[private key decode failed]")
+	assert.Equal(t, 500, http.StatusCode(err), "a misconfigured key must not make Mastodon drop the subscription")
 }
 
 func TestExtractPayloadFailsIfSharedSecretIsInvalid(t *testing.T) {
@@ -183,11 +295,12 @@ func TestExtractPayloadFailsIfSharedSecretIsInvalid(t *testing.T) {
 
 	req := events.LambdaFunctionURLRequest{
 		IsBase64Encoded: true,
-		Headers:         map[string]string{"encryption": b64UrlEncodeKeyVal("salt", "foobar"), "crypto-key": b64UrlEncodeKeyVal("dh", "foobar")},
+		Headers:         map[string]string{"encryption": b64UrlEncodeKeyVal("salt", "0123456789abcdef"), "crypto-key": b64UrlEncodeKeyVal("dh", "foobar")},
 	}
-	_, err := http.ExtractPayload(req)
+	_, err := http.ExtractPayload(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrNotBase64Encoded)
 	assert.ErrorContains(t, err, "[shared secret decode failed]")
+	assert.Equal(t, 500, http.StatusCode(err), "a misconfigured secret must not make Mastodon drop the subscription")
 }
 
 func TestExtractPayloadFailsIfSaltIsInvalid(t *testing.T) {
@@ -207,7 +320,7 @@ func TestExtractPayloadFailsIfSaltIsInvalid(t *testing.T) {
 				IsBase64Encoded: true,
 				Headers:         map[string]string{"encryption": tc.value, "crypto-key": fmt.Sprintf("dh=%s", b64UrlEncode("foo"))},
 			}
-			_, err := http.ExtractPayload(req)
+			_, err := http.ExtractPayload(http.FromFunctionURL(req))
 			assert.ErrorIs(t, err, tc.expectedErr)
 		})
 	}
@@ -217,7 +330,7 @@ func TestExtractPayloadFailsIfEventIsNotBase64Encoded(t *testing.T) {
 	req := events.LambdaFunctionURLRequest{
 		IsBase64Encoded: false,
 	}
-	_, err := http.ExtractPayload(req)
+	_, err := http.ExtractPayload(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrNotBase64Encoded)
 }
 
@@ -238,7 +351,7 @@ func TestExtractPayloadFailsIfTheirPublicKeyIsInvalid(t *testing.T) {
 				IsBase64Encoded: true,
 				Headers:         map[string]string{"crypto-key": tc.value},
 			}
-			_, err := http.ExtractPayload(req)
+			_, err := http.ExtractPayload(http.FromFunctionURL(req))
 			assert.ErrorIs(t, err, tc.expectedErr)
 		})
 	}
@@ -248,7 +361,7 @@ func TestExtractTargetsReturnsEmptySliceWhenNoPath(t *testing.T) {
 	req := events.LambdaFunctionURLRequest{
 		RawPath: "",
 	}
-	result, err := http.ExtractTargets(req)
+	result, err := http.ExtractTargets(http.FromFunctionURL(req))
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(result))
 }
@@ -257,7 +370,7 @@ func TestExtractTargetsReturnsErrorWhenPathIsNotB64Encoded(t *testing.T) {
 	req := events.LambdaFunctionURLRequest{
 		RawPath: "/&&($@/*#*)@",
 	}
-	_, err := http.ExtractTargets(req)
+	_, err := http.ExtractTargets(http.FromFunctionURL(req))
 	assert.ErrorIs(t, err, http.ErrTargetDecode)
 }
 
@@ -281,7 +394,7 @@ func TestExtractTargetsReturnsDecodedPathValues(t *testing.T) {
 			req := events.LambdaFunctionURLRequest{
 				RawPath: tc.input,
 			}
-			result, err := http.ExtractTargets(req)
+			result, err := http.ExtractTargets(http.FromFunctionURL(req))
 			assert.Nil(t, err)
 			assert.Equal(t, tc.count, len(result))
 			assert.Equal(t, "foobar", result[0])
@@ -289,6 +402,34 @@ func TestExtractTargetsReturnsDecodedPathValues(t *testing.T) {
 	}
 }
 
+func TestCheckRequest(t *testing.T) {
+	testCases := []struct {
+		method      string
+		headers     map[string]string
+		expectedErr error
+		desc        string
+	}{
+		{"POST", map[string]string{"content-encoding": "aesgcm"}, nil, "valid"},
+		{"post", map[string]string{"content-encoding": " AESGCM ", "content-type": "application/octet-stream; charset=binary"}, nil, "case and whitespace insensitive"},
+		{"GET", map[string]string{"content-encoding": "aesgcm"}, http.ErrMethodNotAllowed, "get"},
+		{"PUT", map[string]string{"content-encoding": "aesgcm"}, http.ErrMethodNotAllowed, "put"},
+		{"POST", map[string]string{}, http.ErrMissingHeader, "no content encoding"},
+		{"POST", map[string]string{"content-encoding": "aes128gcm"}, http.ErrUnsupportedEncoding, "aes128gcm"},
+		{"POST", map[string]string{"content-encoding": "aesgcm", "content-type": "application/json"}, http.ErrUnsupportedContentType, "json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := http.CheckRequest(&http.Request{Method: tc.method, Headers: tc.headers})
+			if tc.expectedErr == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
 func TestEncodeResponseReturnsStatusCodeAndMessageReceived(t *testing.T) {
 	input := map[string]string{"status": "ok"}
 	expected, _ := json.Marshal(input)
@@ -0,0 +1,256 @@
+package http
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// EventSource identifies the kind of event the lambda was invoked with
+type EventSource int
+
+// Supported event sources
+const (
+	// FunctionURLSource is a lambda function URL
+	FunctionURLSource EventSource = iota
+	// RestAPISource is an API Gateway REST API (payload format 1.0)
+	RestAPISource
+	// HTTPAPISource is an API Gateway HTTP API (payload format 2.0)
+	HTTPAPISource
+	// ALBSource is an application load balancer target group
+	ALBSource
+)
+
+func (s EventSource) String() string {
+	switch s {
+	case RestAPISource:
+		return "RestAPI"
+	case HTTPAPISource:
+		return "HttpAPI"
+	case ALBSource:
+		return "ALB"
+	default:
+		return "FunctionURL"
+	}
+}
+
+// proxyPathParameter is the path parameter of a greedy {proxy+} API Gateway resource
+const proxyPathParameter = "proxy"
+
+// Request is the normalized form of all of the events the lambda can be invoked with
+type Request struct {
+	Source          EventSource
+	Method          string
+	Path            string
+	Headers         map[string]string
+	Body            string
+	IsBase64Encoded bool
+	DomainName      string
+	RequestID       string
+	SourceIP        string
+	multiValue      bool
+}
+
+// FromFunctionURL normalizes a lambda function URL event
+func FromFunctionURL(event events.LambdaFunctionURLRequest) *Request {
+	headers := lowerKeys(event.Headers)
+	return &Request{
+		Source:          FunctionURLSource,
+		Method:          event.RequestContext.HTTP.Method,
+		Path:            event.RawPath,
+		Headers:         headers,
+		Body:            event.Body,
+		IsBase64Encoded: event.IsBase64Encoded,
+		DomainName:      domainName(event.RequestContext.DomainName, headers),
+		RequestID:       event.RequestContext.RequestID,
+		SourceIP:        event.RequestContext.HTTP.SourceIP,
+	}
+}
+
+// FromRestAPI normalizes an API Gateway REST API proxy event; the targets are read from the {proxy+} path parameter when the API defines one, which keeps stages and custom domain base paths out of the target list
+func FromRestAPI(event events.APIGatewayProxyRequest) *Request {
+	headers := lowerKeys(event.Headers)
+	for k, v := range event.MultiValueHeaders {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	return &Request{
+		Source:          RestAPISource,
+		Method:          event.HTTPMethod,
+		Path:            proxyPath(event.PathParameters, event.Path),
+		Headers:         headers,
+		Body:            event.Body,
+		IsBase64Encoded: event.IsBase64Encoded,
+		DomainName:      domainName(event.RequestContext.DomainName, headers),
+		RequestID:       event.RequestContext.RequestID,
+		SourceIP:        event.RequestContext.Identity.SourceIP,
+	}
+}
+
+// FromHTTPAPI normalizes an API Gateway HTTP API event; the targets are read from the {proxy+} path parameter when the route defines one, otherwise the stage is stripped from the raw path
+func FromHTTPAPI(event events.APIGatewayV2HTTPRequest) *Request {
+	headers := lowerKeys(event.Headers)
+	path := event.RawPath
+	if stage := event.RequestContext.Stage; stage != "" && stage != "$default" {
+		path = strings.TrimPrefix(path, "/"+stage)
+	}
+	return &Request{
+		Source:          HTTPAPISource,
+		Method:          event.RequestContext.HTTP.Method,
+		Path:            proxyPath(event.PathParameters, path),
+		Headers:         headers,
+		Body:            event.Body,
+		IsBase64Encoded: event.IsBase64Encoded,
+		DomainName:      domainName(event.RequestContext.DomainName, headers),
+		RequestID:       event.RequestContext.RequestID,
+		SourceIP:        event.RequestContext.HTTP.SourceIP,
+	}
+}
+
+// FromALB normalizes an application load balancer event; the audience is derived from the Host header since ALB events carry no domain name
+func FromALB(event events.ALBTargetGroupRequest) *Request {
+	headers := lowerKeys(event.Headers)
+	for k, v := range event.MultiValueHeaders {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	// the ALB appends the address of its peer to whatever X-Forwarded-For the client sent; only the last entry can be trusted
+	forwarded := strings.Split(headers["x-forwarded-for"], ",")
+	sourceIP := strings.TrimSpace(forwarded[len(forwarded)-1])
+	return &Request{
+		Source:          ALBSource,
+		Method:          event.HTTPMethod,
+		Path:            event.Path,
+		Headers:         headers,
+		Body:            event.Body,
+		IsBase64Encoded: event.IsBase64Encoded,
+		DomainName:      headers["host"],
+		RequestID:       headers["x-amzn-trace-id"],
+		SourceIP:        sourceIP,
+		multiValue:      len(event.MultiValueHeaders) > 0,
+	}
+}
+
+// ParseEvent detects the kind of event in data and normalizes it
+func ParseEvent(data []byte) (*Request, error) {
+	var probe struct {
+		Version        string `json:"version"`
+		HTTPMethod     string `json:"httpMethod"`
+		RequestContext struct {
+			ELB json.RawMessage `json:"elb"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("[event unmarshal failed] %w: %s", ErrInvalidInput, err.Error())
+	}
+
+	var err error
+	switch {
+	case len(probe.RequestContext.ELB) > 0:
+		var event events.ALBTargetGroupRequest
+		if err = json.Unmarshal(data, &event); err == nil {
+			return FromALB(event), nil
+		}
+	case probe.Version == "2.0":
+		// function URL events use the HTTP API payload format; they never have a stage or path parameters so normalize to the same request
+		var event events.APIGatewayV2HTTPRequest
+		if err = json.Unmarshal(data, &event); err == nil {
+			req := FromHTTPAPI(event)
+			if strings.Contains(req.DomainName, ".lambda-url.") {
+				req.Source = FunctionURLSource
+			}
+			return req, nil
+		}
+	case probe.HTTPMethod != "":
+		var event events.APIGatewayProxyRequest
+		if err = json.Unmarshal(data, &event); err == nil {
+			return FromRestAPI(event), nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported event", ErrInvalidInput)
+	}
+	return nil, fmt.Errorf("[event unmarshal failed] %w: %s", ErrInvalidInput, err.Error())
+}
+
+// EncodeFor converts resp into the response expected by the source of req
+func EncodeFor(req *Request, resp *events.LambdaFunctionURLResponse) interface{} {
+	switch req.Source {
+	case RestAPISource:
+		return &events.APIGatewayProxyResponse{
+			StatusCode:      resp.StatusCode,
+			Headers:         resp.Headers,
+			Body:            resp.Body,
+			IsBase64Encoded: resp.IsBase64Encoded,
+		}
+	case ALBSource:
+		alb := &events.ALBTargetGroupResponse{
+			StatusCode:        resp.StatusCode,
+			StatusDescription: fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode)),
+			Body:              resp.Body,
+			IsBase64Encoded:   resp.IsBase64Encoded,
+		}
+		// an ALB with multi value headers enabled ignores the single value headers of a response
+		if req.multiValue {
+			alb.MultiValueHeaders = make(map[string][]string)
+			for k, v := range resp.Headers {
+				alb.MultiValueHeaders[k] = []string{v}
+			}
+		} else {
+			alb.Headers = resp.Headers
+		}
+		return alb
+	case HTTPAPISource:
+		return &events.APIGatewayV2HTTPResponse{
+			StatusCode:      resp.StatusCode,
+			Headers:         resp.Headers,
+			Body:            resp.Body,
+			IsBase64Encoded: resp.IsBase64Encoded,
+			Cookies:         resp.Cookies,
+		}
+	default:
+		return resp
+	}
+}
+
+func lowerKeys(headers map[string]string) map[string]string {
+	result := make(map[string]string, len(headers))
+	for k, v := range headers {
+		result[strings.ToLower(k)] = v
+	}
+	return result
+}
+
+// domainName returns the domain the request was made to; the Host header is used when the event does not provide one
+func domainName(eventDomain string, headers map[string]string) string {
+	if eventDomain != "" {
+		return eventDomain
+	}
+	return headers["host"]
+}
+
+func proxyPath(params map[string]string, path string) string {
+	if proxy, ok := params[proxyPathParameter]; ok {
+		return "/" + strings.TrimPrefix(proxy, "/")
+	}
+	return path
+}
@@ -0,0 +1,147 @@
+package http_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/slugger/mstdnlambda/internal/http"
+	"github.com/stretchr/testify/assert"
+)
+
+const restAPIEvent = `{
+	"resource": "/{proxy+}",
+	"path": "/push/abc/def",
+	"httpMethod": "POST",
+	"headers": {"Authorization": "WebPush tok", "Host": "push.example.com"},
+	"multiValueHeaders": {"Crypto-Key": ["dh=abc", "p256ecdsa=def"]},
+	"pathParameters": {"proxy": "abc/def"},
+	"requestContext": {"requestId": "req-1", "domainName": "push.example.com", "identity": {"sourceIp": "10.1.2.3"}},
+	"body": "Ym9keQ==",
+	"isBase64Encoded": true
+}`
+
+const httpAPIEvent = `{
+	"version": "2.0",
+	"routeKey": "POST /{proxy+}",
+	"rawPath": "/prod/abc/def",
+	"headers": {"authorization": "WebPush tok", "host": "abc123.execute-api.ca-central-1.amazonaws.com"},
+	"requestContext": {"requestId": "req-2", "domainName": "abc123.execute-api.ca-central-1.amazonaws.com", "stage": "prod", "http": {"method": "POST", "sourceIp": "10.1.2.4"}},
+	"body": "Ym9keQ==",
+	"isBase64Encoded": true
+}`
+
+const functionURLEvent = `{
+	"version": "2.0",
+	"routeKey": "$default",
+	"rawPath": "/abc/def",
+	"headers": {"authorization": "WebPush tok"},
+	"requestContext": {"requestId": "req-3", "domainName": "abc123.lambda-url.ca-central-1.on.aws", "stage": "$default", "http": {"method": "POST", "sourceIp": "10.1.2.5"}},
+	"body": "Ym9keQ==",
+	"isBase64Encoded": true
+}`
+
+const albEvent = `{
+	"requestContext": {"elb": {"targetGroupArn": "arn:aws:elasticloadbalancing:ca-central-1:123456789012:targetgroup/push/abc"}},
+	"httpMethod": "POST",
+	"path": "/abc/def",
+	"multiValueHeaders": {"authorization": ["WebPush tok"], "host": ["push.example.com"], "x-forwarded-for": ["203.0.113.9, 10.1.2.6"], "x-amzn-trace-id": ["Root=1-abc"]},
+	"body": "Ym9keQ==",
+	"isBase64Encoded": true
+}`
+
+func TestParseEventNormalizesAllSources(t *testing.T) {
+	testCases := []struct {
+		input     string
+		source    http.EventSource
+		domain    string
+		requestID string
+		sourceIP  string
+	}{
+		{restAPIEvent, http.RestAPISource, "push.example.com", "req-1", "10.1.2.3"},
+		{httpAPIEvent, http.HTTPAPISource, "abc123.execute-api.ca-central-1.amazonaws.com", "req-2", "10.1.2.4"},
+		{functionURLEvent, http.FunctionURLSource, "abc123.lambda-url.ca-central-1.on.aws", "req-3", "10.1.2.5"},
+		{albEvent, http.ALBSource, "push.example.com", "Root=1-abc", "10.1.2.6"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source.String(), func(t *testing.T) {
+			req, err := http.ParseEvent([]byte(tc.input))
+			if assert.Nil(t, err) {
+				assert.Equal(t, tc.source, req.Source)
+				assert.Equal(t, "POST", req.Method)
+				assert.Equal(t, "/abc/def", req.Path)
+				assert.Equal(t, "WebPush tok", req.Headers["authorization"])
+				assert.Equal(t, "Ym9keQ==", req.Body)
+				assert.True(t, req.IsBase64Encoded)
+				assert.Equal(t, tc.domain, req.DomainName)
+				assert.Equal(t, tc.requestID, req.RequestID)
+				assert.Equal(t, tc.sourceIP, req.SourceIP)
+			}
+		})
+	}
+}
+
+func TestParseEventJoinsMultiValueHeaders(t *testing.T) {
+	req, err := http.ParseEvent([]byte(restAPIEvent))
+	assert.Nil(t, err)
+	assert.Equal(t, "dh=abc,p256ecdsa=def", req.Headers["crypto-key"])
+}
+
+func TestParseEventRejectsUnsupportedEvents(t *testing.T) {
+	_, err := http.ParseEvent([]byte(`{"Records":[]}`))
+	assert.ErrorIs(t, err, http.ErrInvalidInput)
+	_, err = http.ParseEvent([]byte("not json"))
+	assert.ErrorIs(t, err, http.ErrInvalidInput)
+}
+
+func TestFromFunctionURLFallsBackToHostHeader(t *testing.T) {
+	req := http.FromFunctionURL(events.LambdaFunctionURLRequest{Headers: map[string]string{"Host": "push.example.com"}})
+	assert.Equal(t, "push.example.com", req.DomainName)
+}
+
+func TestEncodeForMatchesSource(t *testing.T) {
+	resp := http.EncodeResponse(201, "ok")
+
+	req, _ := http.ParseEvent([]byte(restAPIEvent))
+	rest, ok := http.EncodeFor(req, resp).(*events.APIGatewayProxyResponse)
+	if assert.True(t, ok) {
+		assert.Equal(t, 201, rest.StatusCode)
+		assert.Equal(t, resp.Body, rest.Body)
+	}
+
+	req, _ = http.ParseEvent([]byte(httpAPIEvent))
+	v2, ok := http.EncodeFor(req, resp).(*events.APIGatewayV2HTTPResponse)
+	if assert.True(t, ok) {
+		assert.Equal(t, 201, v2.StatusCode)
+	}
+
+	req, _ = http.ParseEvent([]byte(albEvent))
+	alb, ok := http.EncodeFor(req, resp).(*events.ALBTargetGroupResponse)
+	if assert.True(t, ok) {
+		assert.Equal(t, 201, alb.StatusCode)
+		assert.Equal(t, "201 Created", alb.StatusDescription)
+		assert.Nil(t, alb.Headers)
+	}
+
+	req, _ = http.ParseEvent([]byte(functionURLEvent))
+	assert.Equal(t, resp, http.EncodeFor(req, resp))
+}
@@ -24,50 +24,94 @@ import (
 	"crypto/elliptic"
 	b64 "encoding/base64"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 
-	"github.com/aws/aws-lambda-go/events"
+	"github.com/slugger/mstdnlambda/internal/cfg"
 )
 
 const authHeaderName = "authorization"
 const crytoKeyHeaderName = "crypto-key"
 const encryptionHeaderName = "encryption"
+const forwardedHostHeaderName = "x-forwarded-host"
+const contentEncodingHeaderName = "content-encoding"
+const contentTypeHeaderName = "content-type"
 
 const p256CryptoKeyID = "p256ecdsa"
 const dhCryptoKeyID = "dh"
 const saltKeyID = "salt"
+const recordSizeKeyID = "rs"
+const keyIDKey = "keyid"
+
+// Web Push (aesgcm) record rules
+const (
+	saltSize          = 16
+	tagSize           = 16
+	padSize           = 2
+	recordOverhead    = padSize + tagSize
+	minRecordSize     = padSize + 1
+	defaultRecordSize = 4096
+)
 
 const authTokenPrefix = "WebPush "
 
-func parseSalt(event events.LambdaFunctionURLRequest) ([]byte, error) {
+// parseEncryption returns the salt and record size from the encryption header; the record size is 0 if the sender did not set it
+func parseEncryption(event *Request) ([]byte, uint32, error) {
 	hdr := event.Headers[encryptionHeaderName]
 	if hdr == "" {
-		return nil, fmt.Errorf("%w: %s", ErrMissingHeader, encryptionHeaderName)
+		return nil, 0, fmt.Errorf("%w: %s", ErrMissingHeader, encryptionHeaderName)
 	}
 
-	keys, err := parseKeyValHeader(hdr)
+	sets, err := parseKeyValHeader(hdr)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
+	keys := findKeySet(sets, saltKeyID, "")
 	decode, err := b64.RawURLEncoding.DecodeString(keys[saltKeyID])
 	if err != nil {
-		err = fmt.Errorf("[salt decode failed] %w: %s", ErrNotBase64Encoded, err.Error())
+		return nil, 0, fmt.Errorf("[salt decode failed] %w: %s", ErrNotBase64Encoded, err.Error())
 	}
-	return decode, err
+	if len(decode) != saltSize {
+		return nil, 0, fmt.Errorf("%w: salt must be %d bytes", ErrInvalidHeader, saltSize)
+	}
+
+	var rs uint64
+	if v, ok := keys[recordSizeKeyID]; ok {
+		if rs, err = strconv.ParseUint(v, 10, 31); err != nil || rs < minRecordSize {
+			return nil, 0, fmt.Errorf("%w: record size must be between %d and %d", ErrInvalidHeader, minRecordSize, math.MaxInt32)
+		}
+	}
+	return decode, uint32(rs), nil
 }
 
-func parseTheirPublicKey(event events.LambdaFunctionURLRequest) ([]byte, error) {
+// checkRecord enforces the Web Push rule that a message is a single record; an aesgcm record is the padding length, the (padded) plaintext and the auth tag
+func checkRecord(data []byte, rs uint32) error {
+	if rs == 0 {
+		rs = defaultRecordSize
+	}
+	if len(data) < recordOverhead {
+		return fmt.Errorf("%w: body shorter than a record", ErrInvalidInput)
+	}
+	if len(data) > int(rs)+tagSize {
+		return fmt.Errorf("%w: body larger than a single record of %d bytes", ErrInvalidInput, rs)
+	}
+	return nil
+}
+
+func parseTheirPublicKey(event *Request) ([]byte, error) {
 	hdr := event.Headers[crytoKeyHeaderName]
 	if hdr == "" {
 		return nil, fmt.Errorf("%w: %s", ErrMissingHeader, crytoKeyHeaderName)
 	}
 
-	keys, err := parseKeyValHeader(hdr)
+	sets, err := parseKeyValHeader(hdr)
 	if err != nil {
 		return nil, err
 	}
 
+	keys := findKeySet(sets, dhCryptoKeyID, encryptionKeyID(event))
 	decode, err := b64.RawURLEncoding.DecodeString(keys[dhCryptoKeyID])
 	if err != nil {
 		err = fmt.Errorf("[their public key decode failed] %w: %s", ErrNotBase64Encoded, err.Error())
@@ -75,7 +119,7 @@ func parseTheirPublicKey(event events.LambdaFunctionURLRequest) ([]byte, error)
 	return decode, err
 }
 
-func extractBearerToken(event events.LambdaFunctionURLRequest) (string, error) {
+func extractBearerToken(event *Request) (string, error) {
 	authHeader := event.Headers[authHeaderName]
 	if authHeader == "" {
 		return "", fmt.Errorf("%w: %s", ErrMissingHeader, authHeaderName)
@@ -88,18 +132,43 @@ func extractBearerToken(event events.LambdaFunctionURLRequest) (string, error) {
 	return authHeader[len(authTokenPrefix):], nil
 }
 
-func parseP256PublicKey(event events.LambdaFunctionURLRequest) (*ecdsa.PublicKey, error) {
+// audiences returns the JWT audiences accepted for the request: the configured audiences or, if none, the origin of the domain the request was sent to; the origin of the X-Forwarded-Host header is also accepted when the proxy in front of the lambda is trusted to set it
+func audiences(event *Request) []string {
+	result := cfg.Cfg.Audiences()
+	if len(result) == 0 && event.DomainName != "" {
+		result = []string{fmt.Sprintf("https://%s", strings.ToLower(event.DomainName))}
+	}
+	if cfg.Cfg.IsTrustForwardedHost() {
+		host := strings.TrimSpace(strings.Split(event.Headers[forwardedHostHeaderName], ",")[0])
+		aud := fmt.Sprintf("https://%s", strings.ToLower(host))
+		if host != "" && !contains(result, aud) {
+			result = append(append([]string{}, result...), aud)
+		}
+	}
+	return result
+}
+
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+func parseP256PublicKey(event *Request) (*ecdsa.PublicKey, error) {
 	hdr := event.Headers[crytoKeyHeaderName]
 	if hdr == "" {
 		return nil, fmt.Errorf("%w: %s", ErrMissingHeader, crytoKeyHeaderName)
 	}
 
-	cryptoKeys, err := parseKeyValHeader(hdr)
+	sets, err := parseKeyValHeader(hdr)
 	if err != nil {
 		return nil, err
 	}
 
-	return b64ToPublicKey(cryptoKeys[p256CryptoKeyID])
+	return b64ToPublicKey(findKeySet(sets, p256CryptoKeyID, "")[p256CryptoKeyID])
 }
 
 func b64ToPublicKey(input string) (*ecdsa.PublicKey, error) {
@@ -126,15 +195,76 @@ func b64ToPublicKey(input string) (*ecdsa.PublicKey, error) {
 	}, nil
 }
 
-func parseKeyValHeader(hdrVal string) (map[string]string, error) {
-	result := make(map[string]string)
-	keys := strings.Split(hdrVal, ";")
-	for _, pair := range keys {
-		v := strings.Split(pair, "=")
-		if len(v) != 2 {
-			return nil, fmt.Errorf("%w: invalid key/val header: %v", ErrInvalidHeader, v)
+// parseKeyValHeader parses a header of the form key=val;key="val" into its comma separated key sets; keys are case insensitive and must be unique within their set, empty sets are dropped
+func parseKeyValHeader(hdrVal string) ([]map[string]string, error) {
+	result := make([]map[string]string, 0)
+	for _, set := range strings.Split(hdrVal, ",") {
+		keys := make(map[string]string)
+		for _, pair := range strings.Split(set, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			v := strings.SplitN(pair, "=", 2)
+			if len(v) != 2 {
+				return nil, fmt.Errorf("%w: invalid key/val header: %v", ErrInvalidHeader, v)
+			}
+			key := strings.ToLower(strings.TrimSpace(v[0]))
+			val := strings.TrimSpace(v[1])
+			if len(val) >= 2 && strings.HasPrefix(val, `"`) && strings.HasSuffix(val, `"`) {
+				val = val[1 : len(val)-1]
+			}
+			if !isHeaderToken(key, false) || !isHeaderToken(val, true) {
+				return nil, fmt.Errorf("%w: invalid key/val header: %v", ErrInvalidHeader, v)
+			}
+			if _, ok := keys[key]; ok {
+				return nil, fmt.Errorf("%w: duplicate key in header: %s", ErrInvalidHeader, key)
+			}
+			keys[key] = val
+		}
+		if len(keys) > 0 {
+			result = append(result, keys)
 		}
-		result[v[0]] = v[1]
 	}
 	return result, nil
 }
+
+// findKeySet returns the first of sets holding key, preferring the one identified by keyID if given; nil if no set holds key
+func findKeySet(sets []map[string]string, key string, keyID string) map[string]string {
+	var found map[string]string
+	for _, set := range sets {
+		if _, ok := set[key]; !ok {
+			continue
+		}
+		if keyID == "" || set[keyIDKey] == keyID {
+			return set
+		}
+		if found == nil {
+			found = set
+		}
+	}
+	return found
+}
+
+// encryptionKeyID returns the keyid of the encryption header's key set for the record, which identifies its dh in the crypto-key header; empty if there is none
+func encryptionKeyID(event *Request) string {
+	sets, err := parseKeyValHeader(event.Headers[encryptionHeaderName])
+	if err != nil {
+		return ""
+	}
+	return findKeySet(sets, saltKeyID, "")[keyIDKey]
+}
+
+// isHeaderToken returns true iff s is a non-empty run of visible ASCII characters that are not header delimiters; base64 padding is allowed in values
+func isHeaderToken(s string, isVal bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c > '~' || strings.IndexByte(`";,\`, c) >= 0 || (c == '=' && !isVal) {
+			return false
+		}
+	}
+	return true
+}
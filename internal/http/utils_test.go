@@ -0,0 +1,170 @@
+package http
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyValHeaderTolerantInput(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected []map[string]string
+		desc     string
+	}{
+		{"dh=abc;p256ecdsa=def", []map[string]string{{"dh": "abc", "p256ecdsa": "def"}}, "plain"},
+		{" dh = abc ;  p256ecdsa=def ", []map[string]string{{"dh": "abc", "p256ecdsa": "def"}}, "whitespace"},
+		{`dh="abc";p256ecdsa="def"`, []map[string]string{{"dh": "abc", "p256ecdsa": "def"}}, "quoted values"},
+		{"keyid=p256dh;dh=abc, p256ecdsa=def", []map[string]string{{"keyid": "p256dh", "dh": "abc"}, {"p256ecdsa": "def"}}, "comma separated key sets"},
+		{"keyid=a;dh=abc,keyid=b;dh=def", []map[string]string{{"keyid": "a", "dh": "abc"}, {"keyid": "b", "dh": "def"}}, "keys repeated across sets"},
+		{"DH=abc;,", []map[string]string{{"dh": "abc"}}, "keys are case insensitive and empty segments ignored"},
+		{"salt=abc==", []map[string]string{{"salt": "abc=="}}, "padded value"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result, err := parseKeyValHeader(tc.value)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestParseKeyValHeaderRejectsInvalidInput(t *testing.T) {
+	for _, v := range []string{"foobar", "=abc", "dh=", `dh=""`, `dh="ab"c"`, "d h=abc", "dh=abc;dh=def", "keyid=a;dh=abc;KEYID=b"} {
+		_, err := parseKeyValHeader(v)
+		assert.ErrorIs(t, err, ErrInvalidHeader, v)
+	}
+}
+
+func TestKeySetsAreMatchedByKeyID(t *testing.T) {
+	dhA, dhB := base64.RawURLEncoding.EncodeToString([]byte("a")), base64.RawURLEncoding.EncodeToString([]byte("b"))
+	testCases := []struct {
+		encryption string
+		cryptoKey  string
+		expected   string
+		desc       string
+	}{
+		{"salt=MDEyMzQ1Njc4OWFiY2RlZg", "dh=" + dhA + ";p256ecdsa=def", "a", "single set"},
+		{"keyid=b;salt=MDEyMzQ1Njc4OWFiY2RlZg", "keyid=a;dh=" + dhA + ",keyid=b;dh=" + dhB + ",p256ecdsa=def", "b", "set of the record's keyid"},
+		{"salt=MDEyMzQ1Njc4OWFiY2RlZg", "keyid=a;dh=" + dhA + ",keyid=b;dh=" + dhB, "a", "first set without a keyid"},
+		{"keyid=c;salt=MDEyMzQ1Njc4OWFiY2RlZg", "keyid=a;dh=" + dhA + ",keyid=b;dh=" + dhB, "a", "first set for an unknown keyid"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			event := &Request{Headers: map[string]string{encryptionHeaderName: tc.encryption, crytoKeyHeaderName: tc.cryptoKey}}
+			salt, _, err := parseEncryption(event)
+			assert.Nil(t, err)
+			assert.Equal(t, "0123456789abcdef", string(salt))
+			dh, err := parseTheirPublicKey(event)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, string(dh))
+		})
+	}
+}
+
+func TestParseEncryptionRecordSize(t *testing.T) {
+	salt := "salt=MDEyMzQ1Njc4OWFiY2RlZg"
+	testCases := []struct {
+		value    string
+		expected uint32
+		err      error
+		desc     string
+	}{
+		{salt, 0, nil, "default"},
+		{salt + ";rs=8192", 8192, nil, "explicit"},
+		{salt + ";rs=2", 0, ErrInvalidHeader, "too small"},
+		{salt + ";rs=4294967296", 0, ErrInvalidHeader, "too large"},
+		{salt + ";rs=abc", 0, ErrInvalidHeader, "not a number"},
+		{"salt=Zm9vYmFy", 0, ErrInvalidHeader, "short salt"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, rs, err := parseEncryption(&Request{Headers: map[string]string{encryptionHeaderName: tc.value}})
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, rs)
+		})
+	}
+}
+
+func TestCheckRecord(t *testing.T) {
+	assert.Nil(t, checkRecord(make([]byte, recordOverhead), 0))
+	assert.Nil(t, checkRecord(make([]byte, defaultRecordSize+tagSize), 0))
+	assert.ErrorIs(t, checkRecord(make([]byte, recordOverhead-1), 0), ErrInvalidInput)
+	assert.ErrorIs(t, checkRecord(make([]byte, defaultRecordSize+tagSize+1), 0), ErrInvalidInput)
+	assert.Nil(t, checkRecord(make([]byte, 100+tagSize), 100))
+	assert.ErrorIs(t, checkRecord(make([]byte, 101+tagSize), 100), ErrInvalidInput)
+}
+
+func FuzzParseKeyValHeader(f *testing.F) {
+	for _, seed := range []string{
+		"dh=abc;p256ecdsa=def",
+		` dh = "abc" ; p256ecdsa=def `,
+		"keyid=p256dh;dh=abc, p256ecdsa=def",
+		"keyid=a;dh=abc,keyid=b;dh=def",
+		"salt=abc==;rs=4096",
+		"dh=abc;dh=def",
+		"foobar",
+		`dh="`,
+		";;,,",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, hdr string) {
+		result, err := parseKeyValHeader(hdr)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("unexpected error for %q: %v", hdr, err)
+			}
+			return
+		}
+		sets := make([]string, 0, len(result))
+		for _, set := range result {
+			if len(set) == 0 {
+				t.Fatalf("empty set parsed from %q", hdr)
+			}
+			pairs := make([]string, 0, len(set))
+			for k, v := range set {
+				if k == "" || v == "" || k != strings.ToLower(k) || strings.TrimSpace(k) != k || strings.TrimSpace(v) != v {
+					t.Fatalf("unnormalized entry %q=%q parsed from %q", k, v, hdr)
+				}
+				pairs = append(pairs, k+"="+v)
+			}
+			sets = append(sets, strings.Join(pairs, ";"))
+		}
+		// a parsed header must survive being serialized and parsed again
+		again, err := parseKeyValHeader(strings.Join(sets, ","))
+		if err != nil {
+			t.Fatalf("reparse of %q failed: %v", hdr, err)
+		}
+		assert.Equal(t, result, again)
+	})
+}
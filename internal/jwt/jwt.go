@@ -23,6 +23,9 @@ import (
 	"crypto/ecdsa"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	jwtlib "github.com/dgrijalva/jwt-go/v4"
 )
@@ -33,19 +36,24 @@ var ErrInvalidJwtSigningMethod = errors.New("unexpected signing method")
 // ErrJwtParseFailure represents an error denoting that a JWT token could not be parsed properly
 var ErrJwtParseFailure = errors.New("jwt parse failed")
 
-// Verify parses and verifies the given JWT token; returns an error iff the token validation failed otherwise returns nil
+// Verify parses and verifies the given JWT token; returns an error iff the token validation failed for every accepted audience otherwise returns nil
 func Verify(vjwt *VerifiableJwt) error {
-	if _, err := jwtlib.Parse(vjwt.Token, vjwt.publicKey, jwtlib.WithAudience(vjwt.Aud)); err != nil {
-		return fmt.Errorf("%w: %s", ErrJwtParseFailure, err.Error())
+	err := fmt.Errorf("%w: no accepted audience", ErrJwtParseFailure)
+	for _, aud := range vjwt.Aud {
+		if _, perr := jwtlib.Parse(vjwt.Token, vjwt.publicKey, jwtlib.WithAudience(aud)); perr != nil {
+			err = fmt.Errorf("%w: %s", ErrJwtParseFailure, perr.Error())
+			continue
+		}
+		return nil
 	}
-	return nil
+	return err
 }
 
-// VerifiableJwt A dot encoded JWT token, its expected audience and the ECDSA public key needed to verify the token
+// VerifiableJwt A dot encoded JWT token, the audiences it may be issued for and the ECDSA public key needed to verify the token
 type VerifiableJwt struct {
 	Token     string
 	PublicKey *ecdsa.PublicKey
-	Aud       string
+	Aud       []string
 }
 
 func (vjwt *VerifiableJwt) publicKey(token *jwtlib.Token) (interface{}, error) {
@@ -54,3 +62,37 @@ func (vjwt *VerifiableJwt) publicKey(token *jwtlib.Token) (interface{}, error) {
 	}
 	return vjwt.PublicKey, nil
 }
+
+// Claims holds the claims of a push request's JWT token that identify its sender
+type Claims struct {
+	Subject   string
+	ExpiresAt time.Time
+}
+
+// ParseClaims extracts the claims from the given token WITHOUT verifying it; only trust the result once Verify has succeeded
+func ParseClaims(vjwt *VerifiableJwt) (*Claims, error) {
+	var claims jwtlib.StandardClaims
+	if _, _, err := jwtlib.NewParser().ParseUnverified(vjwt.Token, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrJwtParseFailure, err.Error())
+	}
+	result := &Claims{Subject: claims.Subject}
+	if claims.ExpiresAt != nil {
+		result.ExpiresAt = claims.ExpiresAt.Time
+	}
+	return result, nil
+}
+
+// SubjectDomain returns the domain found in a token subject; Mastodon sets the subject to a mailto: URI of the instance's contact address but an https: URI is also accepted
+func SubjectDomain(sub string) string {
+	if strings.HasPrefix(sub, "mailto:") {
+		addr := strings.TrimPrefix(sub, "mailto:")
+		if i := strings.LastIndex(addr, "@"); i >= 0 {
+			return strings.ToLower(addr[i+1:])
+		}
+		return ""
+	}
+	if u, err := url.Parse(sub); err == nil && u.Scheme == "https" {
+		return strings.ToLower(u.Hostname())
+	}
+	return ""
+}
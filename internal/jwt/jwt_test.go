@@ -42,12 +42,33 @@ func TestVerifyJwtSucceeds(t *testing.T) {
 	vtoken := jwt.VerifiableJwt{
 		Token:     encodedToken,
 		PublicKey: &privKey.PublicKey,
-		Aud:       "https://foo.com",
+		Aud:       []string{"https://foo.com"},
 	}
 	err = jwt.Verify(&vtoken)
 	assert.Nil(t, err)
 }
 
+func TestVerifyJwtAcceptsAnyConfiguredAudience(t *testing.T) {
+	privKey := genKey()
+	token := jwtlib.NewWithClaims(jwtlib.SigningMethodES256, jwtlib.MapClaims{"aud": "https://push.example.com", "exp": time.Now().Unix() + 600})
+	encodedToken, err := token.SignedString(privKey)
+	if err != nil {
+		panic(err)
+	}
+	vtoken := jwt.VerifiableJwt{
+		Token:     encodedToken,
+		PublicKey: &privKey.PublicKey,
+		Aud:       []string{"https://foo.lambda-url.ca-central-1.on.aws", "https://push.example.com"},
+	}
+	assert.Nil(t, jwt.Verify(&vtoken))
+
+	vtoken.Aud = []string{"https://foo.lambda-url.ca-central-1.on.aws"}
+	assert.ErrorIs(t, jwt.Verify(&vtoken), jwt.ErrJwtParseFailure)
+
+	vtoken.Aud = nil
+	assert.ErrorIs(t, jwt.Verify(&vtoken), jwt.ErrJwtParseFailure)
+}
+
 func TestVerifyJwtFailsIfValidationFails(t *testing.T) {
 	privKey := genKey()
 	token := jwtlib.NewWithClaims(jwtlib.SigningMethodES256, jwtlib.MapClaims{"aud": "https://foo.com", "exp": 0})
@@ -58,12 +79,51 @@ func TestVerifyJwtFailsIfValidationFails(t *testing.T) {
 	vtoken := jwt.VerifiableJwt{
 		Token:     encodedToken,
 		PublicKey: &privKey.PublicKey,
-		Aud:       "https://foo.com",
+		Aud:       []string{"https://foo.com"},
 	}
 	err = jwt.Verify(&vtoken)
 	assert.ErrorIs(t, err, jwt.ErrJwtParseFailure)
 }
 
+func TestParseClaimsReturnsSubjectAndExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	token := jwtlib.NewWithClaims(jwtlib.SigningMethodES256, jwtlib.MapClaims{"aud": "https://foo.com", "exp": exp, "sub": "mailto:admin@mstdn.ca"})
+	encodedToken, err := token.SignedString(genKey())
+	if err != nil {
+		panic(err)
+	}
+	claims, err := jwt.ParseClaims(&jwt.VerifiableJwt{Token: encodedToken})
+	assert.Nil(t, err)
+	assert.Equal(t, "mailto:admin@mstdn.ca", claims.Subject)
+	assert.Equal(t, exp, claims.ExpiresAt.Unix())
+}
+
+func TestParseClaimsFailsForMalformedToken(t *testing.T) {
+	_, err := jwt.ParseClaims(&jwt.VerifiableJwt{Token: "foobar"})
+	assert.ErrorIs(t, err, jwt.ErrJwtParseFailure)
+}
+
+func TestSubjectDomain(t *testing.T) {
+	testCases := []struct {
+		sub      string
+		expected string
+		desc     string
+	}{
+		{"mailto:admin@mstdn.ca", "mstdn.ca", "mailto subject"},
+		{"mailto:Admin@MSTDN.ca", "mstdn.ca", "mixed case mailto subject"},
+		{"https://mstdn.ca/about", "mstdn.ca", "https subject"},
+		{"mailto:nobody", "", "mailto subject without domain"},
+		{"http://mstdn.ca", "", "insecure subject"},
+		{"", "", "empty subject"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, jwt.SubjectDomain(tc.sub))
+		})
+	}
+}
+
 func TestVerifyFailsIfTokenIsNotUsingES256SigningMethod(t *testing.T) {
 	token := jwtlib.New(jwtlib.SigningMethodHS256) // method HS256 is not acceptable, must be ES256
 	encodedToken, err := token.SignedString([]byte{})
@@ -73,7 +133,7 @@ func TestVerifyFailsIfTokenIsNotUsingES256SigningMethod(t *testing.T) {
 	vtoken := jwt.VerifiableJwt{
 		Token:     encodedToken,
 		PublicKey: nil,
-		Aud:       "foo",
+		Aud:       []string{"foo"},
 	}
 	err = jwt.Verify(&vtoken)
 	assert.ErrorIs(t, err, jwt.ErrJwtParseFailure)
@@ -0,0 +1,144 @@
+package ledger
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/sirupsen/logrus"
+	"github.com/slugger/mstdnlambda/internal/awssession"
+	"github.com/slugger/mstdnlambda/internal/logging"
+)
+
+// DynamoDB attribute names used by the ledger table; the table must use fingerprint as its partition key and target as its sort key
+const (
+	fingerprintAttr = "fingerprint"
+	targetAttr      = "target"
+	deliveredAttr   = "delivered"
+	attemptsAttr    = "attempts"
+	expiresAttr     = "expires"
+)
+
+type dynamoLedger struct {
+	table string
+	ttl   time.Duration
+	svc   dynamodbiface.DynamoDBAPI
+	now   func() time.Time
+}
+
+func newDynamo(table string, ttl time.Duration) Ledger {
+	return NewDynamo(dynamodb.New(awssession.Get()), table, ttl)
+}
+
+// NewDynamo returns a Ledger backed by the given DynamoDB table; entries are written with an expires attribute suitable for use as the table's TTL attribute
+func NewDynamo(svc dynamodbiface.DynamoDBAPI, table string, ttl time.Duration) Ledger {
+	return &dynamoLedger{
+		table: table,
+		ttl:   ttl,
+		svc:   svc,
+		now:   time.Now,
+	}
+}
+
+func (l *dynamoLedger) IsDelivered(ctx context.Context, fingerprint string, target string) (bool, error) {
+	resp, err := l.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(l.table),
+		Key:            l.key(fingerprint, target),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("[ledger get failed] %w: %s", ErrLedgerFailure, err.Error())
+	}
+	if attr, ok := resp.Item[deliveredAttr]; !ok || attr.BOOL == nil || !*attr.BOOL {
+		return false, nil
+	}
+
+	// DynamoDB removes expired items lazily so the expiry must be checked here too
+	attr, ok := resp.Item[expiresAttr]
+	if !ok || attr.N == nil {
+		return true, nil
+	}
+	expires, err := strconv.ParseInt(*attr.N, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("[ledger expiry parse failed] %w: %s", ErrLedgerFailure, err.Error())
+	}
+	return l.now().Unix() < expires, nil
+}
+
+func (l *dynamoLedger) MarkDelivered(ctx context.Context, fingerprint string, target string) error {
+	_, err := l.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(l.table),
+		Key:              l.key(fingerprint, target),
+		UpdateExpression: aws.String(fmt.Sprintf("SET %s = :delivered, %s = :expires", deliveredAttr, expiresAttr)),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":delivered": {BOOL: aws.Bool(true)},
+			":expires":   l.expires(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("[ledger update failed] %w: %s", ErrLedgerFailure, err.Error())
+	}
+	logging.GetLogForContext(ctx, logging.LedgerCategory).WithFields(logrus.Fields{"fingerprint": fingerprint, "target": target}).Debug("delivery recorded")
+	return nil
+}
+
+func (l *dynamoLedger) RecordFailure(ctx context.Context, fingerprint string, target string) (int, error) {
+	resp, err := l.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(l.table),
+		Key:              l.key(fingerprint, target),
+		UpdateExpression: aws.String(fmt.Sprintf("ADD %s :one SET %s = :expires", attemptsAttr, expiresAttr)),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":expires": l.expires(),
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("[ledger update failed] %w: %s", ErrLedgerFailure, err.Error())
+	}
+
+	attr, ok := resp.Attributes[attemptsAttr]
+	if !ok || attr.N == nil {
+		return 0, fmt.Errorf("[ledger attempts missing] %w", ErrLedgerFailure)
+	}
+	attempts, err := strconv.Atoi(*attr.N)
+	if err != nil {
+		return 0, fmt.Errorf("[ledger attempts parse failed] %w: %s", ErrLedgerFailure, err.Error())
+	}
+	logging.GetLogForContext(ctx, logging.LedgerCategory).WithFields(logrus.Fields{"fingerprint": fingerprint, "target": target, "attempts": attempts}).Debug("failure recorded")
+	return attempts, nil
+}
+
+func (l *dynamoLedger) key(fingerprint string, target string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		fingerprintAttr: {S: aws.String(fingerprint)},
+		targetAttr:      {S: aws.String(target)},
+	}
+}
+
+func (l *dynamoLedger) expires() *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(l.now().Add(l.ttl).Unix(), 10))}
+}
@@ -0,0 +1,64 @@
+package ledger
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The ledger package records which targets a notification has already been
+	delivered to. When one target of a multi target request fails, Mastodon
+	retries the entire request; the ledger allows the retry to skip the targets
+	that already succeeded so they do not receive the same message twice.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/devenv"
+)
+
+// ErrLedgerFailure represents an error caused by a failure reading from or writing to the backing store of a Ledger
+var ErrLedgerFailure = errors.New("ledger failure")
+
+// Ledger defines the contract for recording successful deliveries of a notification to its targets
+type Ledger interface {
+	// IsDelivered returns true if the notification identified by fingerprint was previously delivered to target
+	IsDelivered(ctx context.Context, fingerprint string, target string) (bool, error)
+	// MarkDelivered records that the notification identified by fingerprint was delivered to target
+	MarkDelivered(ctx context.Context, fingerprint string, target string) error
+	// RecordFailure records a failed attempt to deliver the notification identified by fingerprint to target and returns the total number of failed attempts recorded so far
+	RecordFailure(ctx context.Context, fingerprint string, target string) (int, error)
+}
+
+// New returns the Ledger implementation selected by the lambda configuration; a DynamoDB table is used when one is configured otherwise deliveries are only remembered in memory
+func New() Ledger {
+	if devenv.IsActive() || cfg.Cfg.LedgerTable() == "" {
+		return NewMemory(cfg.Cfg.LedgerTTL())
+	}
+	return newDynamo(cfg.Cfg.LedgerTable(), cfg.Cfg.LedgerTTL())
+}
+
+// Fingerprint generates the key used to identify a notification in the Ledger; Mastodon re-encrypts a notification for each retry so the fingerprint is computed from the decrypted message
+func Fingerprint(msg string) string {
+	sum := sha256.Sum256([]byte(msg))
+	return hex.EncodeToString(sum[:])
+}
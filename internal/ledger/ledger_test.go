@@ -0,0 +1,159 @@
+package ledger_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/slugger/mstdnlambda/internal/ledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprintIsStableForSameMessage(t *testing.T) {
+	assert.Equal(t, ledger.Fingerprint(`{"foo":"bar"}`), ledger.Fingerprint(`{"foo":"bar"}`))
+	assert.NotEqual(t, ledger.Fingerprint(`{"foo":"bar"}`), ledger.Fingerprint(`{"foo":"baz"}`))
+}
+
+func TestMemoryLedgerRecordsDeliveriesPerTarget(t *testing.T) {
+	sut := ledger.NewMemory(time.Hour)
+	assert.Nil(t, sut.MarkDelivered(context.Background(), "fp", "target1"))
+
+	delivered, err := sut.IsDelivered(context.Background(), "fp", "target1")
+	assert.Nil(t, err)
+	assert.True(t, delivered)
+
+	delivered, err = sut.IsDelivered(context.Background(), "fp", "target2")
+	assert.Nil(t, err)
+	assert.False(t, delivered)
+
+	delivered, err = sut.IsDelivered(context.Background(), "otherfp", "target1")
+	assert.Nil(t, err)
+	assert.False(t, delivered)
+}
+
+func TestMemoryLedgerForgetsExpiredDeliveries(t *testing.T) {
+	sut := ledger.NewMemory(0)
+	assert.Nil(t, sut.MarkDelivered(context.Background(), "fp", "target1"))
+	delivered, err := sut.IsDelivered(context.Background(), "fp", "target1")
+	assert.Nil(t, err)
+	assert.False(t, delivered)
+}
+
+func TestMemoryLedgerCountsFailuresPerTarget(t *testing.T) {
+	sut := ledger.NewMemory(time.Hour)
+	for i := 1; i <= 3; i++ {
+		attempts, err := sut.RecordFailure(context.Background(), "fp", "target1")
+		assert.Nil(t, err)
+		assert.Equal(t, i, attempts)
+	}
+	attempts, err := sut.RecordFailure(context.Background(), "fp", "target2")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts)
+
+	delivered, err := sut.IsDelivered(context.Background(), "fp", "target1")
+	assert.Nil(t, err)
+	assert.False(t, delivered)
+}
+
+func TestDynamoLedgerWritesKeyAndExpiry(t *testing.T) {
+	svc := &mockDynamo{}
+	sut := ledger.NewDynamo(svc, "ledger", time.Hour)
+	assert.Nil(t, sut.MarkDelivered(context.Background(), "fp", "target1"))
+	if assert.NotNil(t, svc.update) {
+		assert.Equal(t, "ledger", *svc.update.TableName)
+		assert.Equal(t, "fp", *svc.update.Key["fingerprint"].S)
+		assert.Equal(t, "target1", *svc.update.Key["target"].S)
+		assert.True(t, *svc.update.ExpressionAttributeValues[":delivered"].BOOL)
+		expires, err := strconv.ParseInt(*svc.update.ExpressionAttributeValues[":expires"].N, 10, 64)
+		assert.Nil(t, err)
+		assert.Greater(t, expires, time.Now().Unix())
+	}
+}
+
+func TestDynamoLedgerIsDelivered(t *testing.T) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	testCases := []struct {
+		item     map[string]*dynamodb.AttributeValue
+		expected bool
+		desc     string
+	}{
+		{nil, false, "item not found"},
+		{map[string]*dynamodb.AttributeValue{"delivered": {BOOL: aws.Bool(true)}, "expires": {N: aws.String(future)}}, true, "item not expired"},
+		{map[string]*dynamodb.AttributeValue{"delivered": {BOOL: aws.Bool(true)}, "expires": {N: aws.String(past)}}, false, "item expired but not yet removed"},
+		{map[string]*dynamodb.AttributeValue{"attempts": {N: aws.String("2")}, "expires": {N: aws.String(future)}}, false, "only failures recorded"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sut := ledger.NewDynamo(&mockDynamo{item: tc.item}, "ledger", time.Hour)
+			delivered, err := sut.IsDelivered(context.Background(), "fp", "target1")
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, delivered)
+		})
+	}
+}
+
+func TestDynamoLedgerRecordFailureReturnsAttempts(t *testing.T) {
+	svc := &mockDynamo{item: map[string]*dynamodb.AttributeValue{"attempts": {N: aws.String("3")}}}
+	sut := ledger.NewDynamo(svc, "ledger", time.Hour)
+	attempts, err := sut.RecordFailure(context.Background(), "fp", "target1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Contains(t, *svc.update.UpdateExpression, "ADD attempts :one")
+}
+
+func TestDynamoLedgerWrapsStoreFailures(t *testing.T) {
+	sut := ledger.NewDynamo(&mockDynamo{err: errors.New("boom")}, "ledger", time.Hour)
+	_, err := sut.IsDelivered(context.Background(), "fp", "target1")
+	assert.ErrorIs(t, err, ledger.ErrLedgerFailure)
+	assert.ErrorIs(t, sut.MarkDelivered(context.Background(), "fp", "target1"), ledger.ErrLedgerFailure)
+	_, err = sut.RecordFailure(context.Background(), "fp", "target1")
+	assert.ErrorIs(t, err, ledger.ErrLedgerFailure)
+}
+
+type mockDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	item   map[string]*dynamodb.AttributeValue
+	update *dynamodb.UpdateItemInput
+	err    error
+}
+
+func (m *mockDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &dynamodb.GetItemOutput{Item: m.item}, nil
+}
+
+func (m *mockDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.update = input
+	return &dynamodb.UpdateItemOutput{Attributes: m.item}, nil
+}
@@ -0,0 +1,96 @@
+package ledger
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	delivered bool
+	attempts  int
+	expires   time.Time
+}
+
+type memoryLedger struct {
+	ttl     time.Duration
+	entries map[string]*memoryEntry
+	lock    sync.Mutex
+	now     func() time.Time
+}
+
+// NewMemory returns a Ledger that only remembers deliveries for the life of the process; entries are forgotten once ttl has elapsed
+func NewMemory(ttl time.Duration) Ledger {
+	return &memoryLedger{
+		ttl:     ttl,
+		entries: make(map[string]*memoryEntry),
+		now:     time.Now,
+	}
+}
+
+func (l *memoryLedger) IsDelivered(ctx context.Context, fingerprint string, target string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e, ok := l.entries[memoryKey(fingerprint, target)]
+	return ok && e.delivered && l.now().Before(e.expires), nil
+}
+
+func (l *memoryLedger) MarkDelivered(ctx context.Context, fingerprint string, target string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entry(fingerprint, target).delivered = true
+	return nil
+}
+
+func (l *memoryLedger) RecordFailure(ctx context.Context, fingerprint string, target string) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e := l.entry(fingerprint, target)
+	e.attempts++
+	return e.attempts, nil
+}
+
+// entry returns the live entry for the key, creating it if needed and extending its expiry; callers must hold the lock
+func (l *memoryLedger) entry(fingerprint string, target string) *memoryEntry {
+	l.prune()
+	k := memoryKey(fingerprint, target)
+	e, ok := l.entries[k]
+	if !ok {
+		e = &memoryEntry{}
+		l.entries[k] = e
+	}
+	e.expires = l.now().Add(l.ttl)
+	return e
+}
+
+func (l *memoryLedger) prune() {
+	now := l.now()
+	for k, e := range l.entries {
+		if !now.Before(e.expires) {
+			delete(l.entries, k)
+		}
+	}
+}
+
+func memoryKey(fingerprint string, target string) string {
+	return fingerprint + "|" + target
+}
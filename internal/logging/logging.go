@@ -20,10 +20,15 @@ package logging
 */
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"math/rand"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/devenv"
 )
 
 // LogCategory represents a known logging category type
@@ -32,23 +37,40 @@ type LogCategory int
 // Supported logging categories
 const (
 	DefaultCategory LogCategory = iota
+	DeadLetterCategory
+	DedupCategory
 	DevEnvCategory
 	DevEnvNotificationCategory
+	EnrichCategory
 	HTTPCategory
 	LambdaCategory
+	LedgerCategory
+	RateLimitCategory
 	SnsNotificationCategory
+	// categoryCount is the number of categories; must remain last
+	categoryCount
 )
 
 func (c LogCategory) String() string {
 	switch c {
+	case DeadLetterCategory:
+		return "DeadLetter"
+	case DedupCategory:
+		return "dedup"
 	case DevEnvCategory:
 		return "DevEnv"
 	case DevEnvNotificationCategory:
 		return "DevEnvNotify"
+	case EnrichCategory:
+		return "enrich"
 	case LambdaCategory:
 		return "lambda"
 	case HTTPCategory:
 		return "http"
+	case LedgerCategory:
+		return "ledger"
+	case RateLimitCategory:
+		return "ratelimit"
 	case SnsNotificationCategory:
 		return "SnsNotify"
 	default:
@@ -56,48 +78,129 @@ func (c LogCategory) String() string {
 	}
 }
 
+// ParseCategory returns the category with the given name, ignoring case
+func ParseCategory(name string) (LogCategory, bool) {
+	for c := DefaultCategory; c < categoryCount; c++ {
+		if strings.EqualFold(c.String(), name) {
+			return c, true
+		}
+	}
+	return DefaultCategory, false
+}
+
 // Log is the global log entry; preconfigured based on lambda configuration options
 var Log *log.Entry
 
+// categoryLoggers holds the loggers of the categories given their own level; all others log through the global logger
+var categoryLoggers map[LogCategory]*log.Logger
+
 func init() {
 	Reset()
 }
 
-// Reset puts the global logger back to its original state; should be called on each invocation of the lambda
+// Reset puts the global logger back to its original state; called once the config is parsed. Fields specific to an invocation belong in the context logger (see NewContext) rather than the global one
 func Reset() {
+	l := newLogger(cfg.Cfg.LogLevel())
+	Log = log.NewEntry(l)
+
+	categoryLoggers = make(map[LogCategory]*log.Logger)
+	for name, lvl := range cfg.Cfg.LogLevels() {
+		cat, ok := ParseCategory(name)
+		if !ok {
+			l.Warnf("unknown log category, level ignored [%s]", name)
+			continue
+		}
+		categoryLoggers[cat] = newLogger(lvl)
+	}
+}
+
+// newLogger returns a logger writing in the configured format at the given level
+func newLogger(level string) *log.Logger {
 	l := log.New()
-	l.SetFormatter(&log.JSONFormatter{})
+	if format := cfg.Cfg.LogFormat(); format == cfg.LogFormatText || (format == cfg.LogFormatDefault && devenv.IsActive()) {
+		l.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	} else {
+		l.SetFormatter(&log.JSONFormatter{})
+	}
 
-	lvl, err := log.ParseLevel(cfg.Cfg.LogLevel())
+	lvl, err := log.ParseLevel(level)
 	if err == nil {
 		l.SetLevel(lvl)
 	} else {
 		l.SetLevel(log.DebugLevel)
-		l.Warnf("invalid log level set, debug assumed [%s]", cfg.Cfg.LogLevel())
+		l.Warnf("invalid log level set, debug assumed [%s]", level)
 	}
-	Log = log.NewEntry(l)
+	return l
+}
+
+// SetOutput redirects all loggers to w and returns the previous output of the global logger
+func SetOutput(w io.Writer) io.Writer {
+	prev := Log.Logger.Out
+	Log.Logger.SetOutput(w)
+	for _, l := range categoryLoggers {
+		l.SetOutput(w)
+	}
+	return prev
 }
 
 // GetLogForCategory returns a configured log.Entry for the given category
 func GetLogForCategory(cat LogCategory) *log.Entry {
-	return Log.WithField("category", cat.String())
+	return forCategory(Log, cat)
+}
+
+// forCategory returns entry tagged with the category, switched to the category's logger if it has its own level
+func forCategory(entry *log.Entry, cat LogCategory) *log.Entry {
+	if l, ok := categoryLoggers[cat]; ok {
+		entry = log.NewEntry(l).WithFields(entry.Data)
+	}
+	return entry.WithField("category", cat.String())
 }
 
 // AddField allows adding a structured field and value to the global log entry; it does not add the field to the global entry itself but instead returns a new Entry with the field added
+//
+// Deprecated: fields are no longer added to the global entry since they would leak into later invocations of a warm lambda; use WithFields to add them to the context logger
 func AddField(key string, val interface{}) *log.Entry {
-	Log = Log.WithField(key, val)
-	return Log
+	return Log.WithField(key, val)
 }
 
-// AddFields allows for the adding of multiple structure fields to the global log.Entry
+// AddFields allows for the adding of multiple structure fields to the global log.Entry; like AddField, a new Entry is returned and the global entry is left untouched
+//
+// Deprecated: use WithFields to add fields to the context logger
 func AddFields(fields log.Fields) *log.Entry {
-	Log = Log.WithFields(fields)
+	return Log.WithFields(fields)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying entry as the logger for the request being handled
+func NewContext(ctx context.Context, entry *log.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext returns the logger carried by ctx; the global Log if ctx carries none
+func FromContext(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(contextKey{}).(*log.Entry); ok {
+		return entry
+	}
 	return Log
 }
 
-// LogAsJSON is a convienence method to easily marshal the subject to a json string and log that value in the structured field named "subject"
+// WithFields returns a copy of ctx whose logger has the given fields added; every entry logged through the returned context carries them
+func WithFields(ctx context.Context, fields log.Fields) context.Context {
+	return NewContext(ctx, FromContext(ctx).WithFields(fields))
+}
+
+// GetLogForContext returns the logger carried by ctx for the given category
+func GetLogForContext(ctx context.Context, cat LogCategory) *log.Entry {
+	return forCategory(FromContext(ctx), cat)
+}
+
+// LogAsJSON is a convienence method to easily marshal the subject to a json string and log that value in the structured field named "subject"; debug and trace dumps are sampled at the configured rate. With skipIfDebug, nothing is logged if the subject was already dumped at debug level, which can only be assumed when debug dumps are not sampled
 func LogAsJSON(entry *log.Entry, lvl log.Level, subject interface{}, msg string, skipIfDebug bool) {
-	if !entry.Logger.IsLevelEnabled(lvl) || (skipIfDebug && entry.Logger.IsLevelEnabled(log.DebugLevel)) {
+	if !entry.Logger.IsLevelEnabled(lvl) || (skipIfDebug && entry.Logger.IsLevelEnabled(log.DebugLevel) && cfg.Cfg.LogSampleRate() >= 1) {
+		return
+	}
+	if lvl >= log.DebugLevel && !sampled() {
 		return
 	}
 
@@ -108,3 +211,16 @@ func LogAsJSON(entry *log.Entry, lvl log.Level, subject interface{}, msg string,
 		Log.WithField("err", err).Error("json marshal failed")
 	}
 }
+
+// sampled decides whether a debug dump is logged, given the configured sample rate
+func sampled() bool {
+	rate := cfg.Cfg.LogSampleRate()
+	switch {
+	case rate >= 1:
+		return true
+	case rate <= 0:
+		return false
+	default:
+		return rand.Float64() < rate
+	}
+}
@@ -0,0 +1,183 @@
+package logging_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddFieldDoesNotModifyGlobalLog(t *testing.T) {
+	orig := logging.Log
+	entry := logging.AddField("requestId", "abc")
+	logging.AddFields(logrus.Fields{"instance": "mstdn.ca"})
+
+	assert.Equal(t, "abc", entry.Data["requestId"])
+	assert.Same(t, orig, logging.Log)
+	assert.Empty(t, logging.Log.Data)
+}
+
+func TestFromContextDefaultsToGlobalLog(t *testing.T) {
+	assert.Same(t, logging.Log, logging.FromContext(context.Background()))
+}
+
+func TestContextLoggerCarriesFields(t *testing.T) {
+	out := captureLog(t)
+
+	ctx := logging.NewContext(context.Background(), logging.Log.WithField("requestId", "abc"))
+	child := logging.WithFields(ctx, logrus.Fields{"notificationId": "1"})
+	logging.GetLogForContext(child, logging.LambdaCategory).Info("child")
+	logging.GetLogForContext(ctx, logging.LambdaCategory).Info("parent")
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if assert.Equal(t, 2, len(lines)) {
+		entry := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(lines[0], &entry))
+		assert.Equal(t, "abc", entry["requestId"])
+		assert.Equal(t, "1", entry["notificationId"])
+		assert.Equal(t, "lambda", entry["category"])
+
+		entry = make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(lines[1], &entry))
+		assert.Equal(t, "abc", entry["requestId"])
+		assert.NotContains(t, entry, "notificationId")
+	}
+}
+
+func TestParseCategoryIgnoresCase(t *testing.T) {
+	cat, ok := logging.ParseCategory("snsnotify")
+	assert.True(t, ok)
+	assert.Equal(t, logging.SnsNotificationCategory, cat)
+	_, ok = logging.ParseCategory("nope")
+	assert.False(t, ok)
+}
+
+func TestCategoriesHaveTheirOwnLevels(t *testing.T) {
+	initLogging(t, map[string]string{"MSTDN_LOG_LEVEL": "warn", "MSTDN_LOG_LEVELS": "SnsNotify=debug, lambda = error"})
+	out := captureLog(t)
+
+	ctx := logging.NewContext(context.Background(), logging.Log.WithField("requestId", "abc"))
+	logging.GetLogForCategory(logging.SnsNotificationCategory).Debug("sns debug")
+	logging.GetLogForContext(ctx, logging.LambdaCategory).Warn("lambda warn")
+	logging.GetLogForContext(ctx, logging.LambdaCategory).Error("lambda error")
+	logging.GetLogForCategory(logging.LedgerCategory).Info("ledger info")
+	logging.GetLogForCategory(logging.LedgerCategory).Warn("ledger warn")
+
+	entries := entries(t, out)
+	if assert.Equal(t, 3, len(entries)) {
+		assert.Equal(t, "sns debug", entries[0]["msg"])
+		assert.Equal(t, "lambda error", entries[1]["msg"])
+		assert.Equal(t, "abc", entries[1]["requestId"])
+		assert.Equal(t, "lambda", entries[1]["category"])
+		assert.Equal(t, "ledger warn", entries[2]["msg"])
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	initLogging(t, map[string]string{"MSTDN_LOG_FORMAT": "text"})
+	out := captureLog(t)
+
+	logging.GetLogForCategory(logging.LambdaCategory).Info("hello")
+	assert.Contains(t, out.String(), `msg=hello category=lambda`)
+}
+
+func TestParseConfigRejectsInvalidLogSettings(t *testing.T) {
+	for _, vals := range []map[string]string{
+		{"MSTDN_LOG_LEVELS": "lambda"},
+		{"MSTDN_LOG_FORMAT": "xml"},
+		{"MSTDN_LOG_SAMPLE_RATE": "1.5"},
+	} {
+		assert.Panics(t, func() { initLogging(t, vals) })
+	}
+}
+
+func TestLogAsJSONSamplesDebugDumps(t *testing.T) {
+	initLogging(t, map[string]string{"MSTDN_LOG_LEVEL": "debug", "MSTDN_LOG_SAMPLE_RATE": "0"})
+	out := captureLog(t)
+
+	log := logging.GetLogForCategory(logging.LambdaCategory)
+	logging.LogAsJSON(log, logrus.DebugLevel, map[string]string{"a": "b"}, "event logged", false)
+	assert.Equal(t, 0, out.Len())
+
+	// the debug dump may not have happened so errors are dumped regardless
+	logging.LogAsJSON(log, logrus.ErrorLevel, map[string]string{"a": "b"}, "failed", true)
+	entries := entries(t, out)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, `{"a":"b"}`, entries[0]["subject"])
+	}
+}
+
+func TestLogAsJSONSkipsErrorDumpWhenDebugDumped(t *testing.T) {
+	initLogging(t, map[string]string{"MSTDN_LOG_LEVEL": "debug"})
+	out := captureLog(t)
+
+	log := logging.GetLogForCategory(logging.LambdaCategory)
+	logging.LogAsJSON(log, logrus.DebugLevel, map[string]string{"a": "b"}, "event logged", false)
+	logging.LogAsJSON(log, logrus.ErrorLevel, map[string]string{"a": "b"}, "failed", true)
+	entries := entries(t, out)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, "event logged", entries[0]["msg"])
+	}
+}
+
+func entries(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// initLogging configures the loggers from the given env vars; the original config and loggers are restored once the test completes
+func initLogging(t *testing.T, vals map[string]string) {
+	orig := cfg.Cfg
+	t.Cleanup(func() {
+		cfg.Cfg = orig
+		logging.Reset()
+	})
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	for k, v := range vals {
+		t.Setenv(k, v)
+	}
+	cfg.ParseConfig()
+	logging.Reset()
+}
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	out := &bytes.Buffer{}
+	orig := logging.SetOutput(out)
+	t.Cleanup(func() { logging.SetOutput(orig) })
+	return out
+}
@@ -0,0 +1,160 @@
+package logging
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+)
+
+// Names of the metrics emitted by the lambda
+const (
+	MetricReceived      = "received"
+	MetricJwtFailed     = "jwt_failed"
+	MetricDecryptFailed = "decrypt_failed"
+	MetricPublished     = "published"
+	MetricPublishFailed = "publish_failed"
+	MetricLatency       = "latency"
+)
+
+// Names of the metric dimensions
+const (
+	DimNotificationType = "NotificationType"
+	DimTargetService    = "TargetService"
+	DimStage            = "Stage"
+)
+
+// Names of the metric properties; properties are logged with the metric but are not dimensions so they can be queried in CloudWatch Logs Insights without adding metrics
+const (
+	PropTarget = "Target"
+)
+
+// Units of the metric values
+const (
+	UnitCount        = "Count"
+	UnitMilliseconds = "Milliseconds"
+)
+
+// Dimensions holds the dimension values a metric is recorded with
+type Dimensions map[string]string
+
+// Metrics emits metrics in the CloudWatch Embedded Metric Format (EMF); CloudWatch extracts them from the lambda's output so no API calls are made. A nil Metrics discards everything
+type Metrics struct {
+	namespace  string
+	properties map[string]string
+}
+
+// metricsOutput is where EMF records are written; replaced in tests
+var metricsOutput io.Writer = os.Stdout
+var metricsLock sync.Mutex
+
+// NewMetrics returns the Metrics configured for the lambda; nil if metrics are disabled
+func NewMetrics() *Metrics {
+	if !cfg.Cfg.IsMetricsEnabled() {
+		return nil
+	}
+	return &Metrics{namespace: cfg.Cfg.MetricsNamespace()}
+}
+
+// SetMetricsOutput redirects the EMF records to w and returns the previous output
+func SetMetricsOutput(w io.Writer) io.Writer {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	prev := metricsOutput
+	metricsOutput = w
+	return prev
+}
+
+// WithProperty returns a copy of m whose records also carry the property key; a nil Metrics stays nil
+func (m *Metrics) WithProperty(key string, val string) *Metrics {
+	if m == nil {
+		return nil
+	}
+	props := make(map[string]string, len(m.properties)+1)
+	for k, v := range m.properties {
+		props[k] = v
+	}
+	props[key] = val
+	return &Metrics{namespace: m.namespace, properties: props}
+}
+
+// Count records one occurrence of the named metric
+func (m *Metrics) Count(name string, dims Dimensions) {
+	m.emit(name, UnitCount, 1, dims)
+}
+
+// Latency records how long the given stage took
+func (m *Metrics) Latency(stage string, elapsed time.Duration, dims Dimensions) {
+	all := Dimensions{DimStage: stage}
+	for k, v := range dims {
+		all[k] = v
+	}
+	m.emit(MetricLatency, UnitMilliseconds, float64(elapsed)/float64(time.Millisecond), all)
+}
+
+// emit writes one EMF record with all dimensions in a single set; dimensions must have few values since CloudWatch bills each combination as a metric of its own, which is why values such as the target are properties instead
+func (m *Metrics) emit(name string, unit string, value float64, dims Dimensions) {
+	if m == nil {
+		return
+	}
+	set := make([]string, 0, len(dims))
+	for k := range dims {
+		set = append(set, k)
+	}
+	sort.Strings(set)
+	sets := [][]string{set}
+
+	record := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []interface{}{
+				map[string]interface{}{
+					"Namespace":  m.namespace,
+					"Dimensions": sets,
+					"Metrics":    []interface{}{map[string]string{"Name": name, "Unit": unit}},
+				},
+			},
+		},
+		name: value,
+	}
+	for k, v := range m.properties {
+		record[k] = v
+	}
+	for k, v := range dims {
+		record[k] = v
+	}
+	enc, err := json.Marshal(record)
+	if err != nil {
+		Log.WithField("err", err).Error("metric marshal failed")
+		return
+	}
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if _, err = metricsOutput.Write(append(enc, '\n')); err != nil {
+		Log.WithField("err", err).Error("metric write failed")
+	}
+}
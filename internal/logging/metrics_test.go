@@ -0,0 +1,132 @@
+package logging_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slugger/mstdnlambda/internal/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountEmitsEmfRecord(t *testing.T) {
+	initLogging(t, map[string]string{"MSTDN_METRICS_NAMESPACE": "test"})
+	out := captureMetrics(t)
+
+	logging.NewMetrics().Count(logging.MetricPublished, logging.Dimensions{
+		logging.DimTargetService:    "sns",
+		logging.DimNotificationType: "mention",
+	})
+
+	recs := records(t, out)
+	if assert.Equal(t, 1, len(recs)) {
+		rec := recs[0]
+		assert.Equal(t, float64(1), rec[logging.MetricPublished])
+		assert.Equal(t, "mention", rec[logging.DimNotificationType])
+		assert.Equal(t, "sns", rec[logging.DimTargetService])
+
+		aws := rec["_aws"].(map[string]interface{})
+		assert.NotZero(t, aws["Timestamp"])
+		directive := aws["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, "test", directive["Namespace"])
+		assert.Equal(t, []interface{}{
+			[]interface{}{logging.DimNotificationType, logging.DimTargetService},
+		}, directive["Dimensions"])
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{"Name": logging.MetricPublished, "Unit": logging.UnitCount},
+		}, directive["Metrics"])
+	}
+}
+
+func TestLatencyAddsStageDimension(t *testing.T) {
+	initLogging(t, map[string]string{})
+	out := captureMetrics(t)
+
+	logging.NewMetrics().Latency("publish", 1500*time.Microsecond, logging.Dimensions{logging.DimTargetService: "sns"})
+
+	recs := records(t, out)
+	if assert.Equal(t, 1, len(recs)) {
+		rec := recs[0]
+		assert.Equal(t, 1.5, rec[logging.MetricLatency])
+		assert.Equal(t, "publish", rec[logging.DimStage])
+		assert.Equal(t, "sns", rec[logging.DimTargetService])
+		directive := rec["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, "mstdnlambda", directive["Namespace"])
+		assert.Equal(t, []interface{}{
+			[]interface{}{logging.DimStage, logging.DimTargetService},
+		}, directive["Dimensions"])
+		assert.Equal(t, logging.UnitMilliseconds, directive["Metrics"].([]interface{})[0].(map[string]interface{})["Unit"])
+	}
+}
+
+func TestPropertiesAreLoggedButNotDimensions(t *testing.T) {
+	initLogging(t, map[string]string{})
+	out := captureMetrics(t)
+
+	m := logging.NewMetrics()
+	m.WithProperty(logging.PropTarget, "arn:aws:sns:us-east-1:123456789012:topic").Count(logging.MetricPublished, logging.Dimensions{logging.DimTargetService: "sns"})
+	m.Count(logging.MetricReceived, nil)
+
+	recs := records(t, out)
+	if assert.Equal(t, 2, len(recs)) {
+		assert.Equal(t, "arn:aws:sns:us-east-1:123456789012:topic", recs[0][logging.PropTarget])
+		directive := recs[0]["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, []interface{}{[]interface{}{logging.DimTargetService}}, directive["Dimensions"])
+		assert.NotContains(t, recs[1], logging.PropTarget, "the property is only added to the copy")
+	}
+}
+
+func TestDisabledMetricsEmitNothing(t *testing.T) {
+	initLogging(t, map[string]string{"MSTDN_METRICS": "false"})
+	out := captureMetrics(t)
+
+	m := logging.NewMetrics()
+	assert.Nil(t, m)
+	m.Count(logging.MetricReceived, nil)
+	m.Latency("total", time.Second, nil)
+	assert.Nil(t, m.WithProperty(logging.PropTarget, "target1"))
+	assert.Equal(t, 0, out.Len())
+}
+
+func captureMetrics(t *testing.T) *bytes.Buffer {
+	out := &bytes.Buffer{}
+	orig := logging.SetMetricsOutput(out)
+	t.Cleanup(func() { logging.SetMetricsOutput(orig) })
+	return out
+}
+
+func records(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var recs []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		rec := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
@@ -0,0 +1,121 @@
+package notify
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/sirupsen/logrus"
+	"github.com/slugger/mstdnlambda/internal/logging"
+)
+
+// ExtendedPayloadSizeAttr is the attribute the AWS extended client libraries use to detect a message whose body was offloaded to S3; its value is the size of the original body
+const ExtendedPayloadSizeAttr = "ExtendedPayloadSize"
+
+// payloadPointerClass is the class name the AWS extended client libraries expect as the first element of a pointer message
+const payloadPointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+
+type payloadPointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+type claimCheckNotifier struct {
+	inner     Notifier
+	svc       s3iface.S3API
+	bucket    string
+	prefix    string
+	threshold int
+}
+
+// NewClaimCheck wraps the given Notifier such that messages larger than threshold bytes have their body stored in S3 under the prefix directory and a pointer to the object is sent instead; the pointer follows the AWS extended client convention so subscribers using those libraries receive the original body transparently
+func NewClaimCheck(inner Notifier, svc s3iface.S3API, bucket string, prefix string, threshold int) Notifier {
+	return &claimCheckNotifier{
+		inner:     inner,
+		svc:       svc,
+		bucket:    bucket,
+		prefix:    prefix,
+		threshold: threshold,
+	}
+}
+
+func (n *claimCheckNotifier) Send(ctx context.Context, msg *Message) error {
+	size := messageSize(msg)
+	if size <= n.threshold {
+		return n.inner.Send(ctx, msg)
+	}
+
+	key := path.Join(n.prefix, newObjectID())
+	if _, err := n.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(n.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader([]byte(msg.Body)),
+	}); err != nil {
+		return fmt.Errorf("[payload offload failed] %w", err)
+	}
+	logging.GetLogForContext(ctx, logging.SnsNotificationCategory).WithFields(logrus.Fields{"key": key, "size": size}).Debug("payload offloaded")
+
+	pointer, err := json.Marshal([]interface{}{payloadPointerClass, payloadPointer{Bucket: n.bucket, Key: key}})
+	if err != nil {
+		return fmt.Errorf("[pointer marshal failed] %w", err)
+	}
+
+	// the message is shared by all targets so a copy is sent in its place
+	attrs := make(map[string]string, len(msg.Attributes)+1)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	attrs[ExtendedPayloadSizeAttr] = strconv.Itoa(len(msg.Body))
+	ptr := *msg
+	ptr.Body = string(pointer)
+	ptr.Attributes = attrs
+	return n.inner.Send(ctx, &ptr)
+}
+
+// messageSize returns the size of the message as counted against the SNS and SQS message size limit, which includes the attributes
+func messageSize(msg *Message) int {
+	size := len(msg.Body)
+	for k, v := range msg.Attributes {
+		if v != "" {
+			size += len(k) + len(v) + len(attributeDataType(k))
+		}
+	}
+	return size
+}
+
+// newObjectID returns a random UUID, matching the object keys generated by the AWS extended client libraries
+func newObjectID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40
+	buf[8] = (buf[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:])
+}
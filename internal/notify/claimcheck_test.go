@@ -0,0 +1,138 @@
+package notify_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/slugger/mstdnlambda/internal/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimCheckSendsSmallMessagesUnchanged(t *testing.T) {
+	inner := &recordingNotifier{}
+	svc := &mockS3{}
+	sut := notify.NewClaimCheck(inner, svc, "bucket", "offload/", 100)
+	msg := &notify.Message{Body: "small", Attributes: map[string]string{"notification_type": "mention"}}
+
+	assert.Nil(t, sut.Send(context.Background(), msg))
+	assert.Same(t, msg, inner.sent)
+	assert.Nil(t, svc.input)
+}
+
+func TestClaimCheckOffloadsLargeMessages(t *testing.T) {
+	inner := &recordingNotifier{}
+	svc := &mockS3{}
+	sut := notify.NewClaimCheck(inner, svc, "bucket", "offload/", 100)
+	body := strings.Repeat("x", 101)
+	msg := &notify.Message{Body: body, Attributes: map[string]string{"notification_type": "mention"}}
+
+	assert.Nil(t, sut.Send(context.Background(), msg))
+	if assert.NotNil(t, svc.input) && assert.NotNil(t, inner.sent) {
+		assert.Equal(t, "bucket", *svc.input.Bucket)
+		assert.True(t, strings.HasPrefix(*svc.input.Key, "offload/"))
+		stored, err := io.ReadAll(svc.input.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, body, string(stored))
+
+		var pointer []interface{}
+		assert.Nil(t, json.Unmarshal([]byte(inner.sent.Body), &pointer))
+		assert.Equal(t, "software.amazon.payloadoffloading.PayloadS3Pointer", pointer[0])
+		assert.Equal(t, map[string]interface{}{"s3BucketName": "bucket", "s3Key": *svc.input.Key}, pointer[1])
+		assert.Equal(t, "101", inner.sent.Attributes[notify.ExtendedPayloadSizeAttr])
+		assert.Equal(t, "mention", inner.sent.Attributes["notification_type"])
+	}
+
+	// the original message is shared with other targets and must not be altered
+	assert.Equal(t, body, msg.Body)
+	assert.NotContains(t, msg.Attributes, notify.ExtendedPayloadSizeAttr)
+}
+
+func TestClaimCheckStoresObjectsUnderPrefixDirectory(t *testing.T) {
+	testCases := []struct {
+		prefix   string
+		expected string
+	}{
+		{"offload", "offload/"},
+		{"offload/", "offload/"},
+		{"a/b", "a/b/"},
+		{"", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.prefix, func(t *testing.T) {
+			svc := &mockS3{}
+			sut := notify.NewClaimCheck(&recordingNotifier{}, svc, "bucket", tc.prefix, 10)
+			assert.Nil(t, sut.Send(context.Background(), &notify.Message{Body: strings.Repeat("x", 11)}))
+			if assert.NotNil(t, svc.input) {
+				key := *svc.input.Key
+				assert.True(t, strings.HasPrefix(key, tc.expected), key)
+				assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, strings.TrimPrefix(key, tc.expected))
+			}
+		})
+	}
+}
+
+func TestClaimCheckCountsAttributesTowardsThreshold(t *testing.T) {
+	inner := &recordingNotifier{}
+	svc := &mockS3{}
+	sut := notify.NewClaimCheck(inner, svc, "bucket", "", 100)
+	msg := &notify.Message{Body: strings.Repeat("x", 90), Attributes: map[string]string{"notification_type": "mention"}}
+
+	assert.Nil(t, sut.Send(context.Background(), msg))
+	assert.NotNil(t, svc.input)
+}
+
+func TestClaimCheckFailsWhenOffloadFails(t *testing.T) {
+	inner := &recordingNotifier{}
+	sut := notify.NewClaimCheck(inner, &mockS3{err: errors.New("boom")}, "bucket", "", 1)
+	assert.NotNil(t, sut.Send(context.Background(), &notify.Message{Body: "too big"}))
+	assert.Nil(t, inner.sent)
+}
+
+type recordingNotifier struct {
+	sent *notify.Message
+}
+
+func (n *recordingNotifier) Send(ctx context.Context, msg *notify.Message) error {
+	n.sent = msg
+	return nil
+}
+
+type mockS3 struct {
+	s3iface.S3API
+	input *s3.PutObjectInput
+	err   error
+}
+
+func (m *mockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.input = input
+	return &s3.PutObjectOutput{}, nil
+}
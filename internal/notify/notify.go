@@ -20,38 +20,98 @@ package notify
 */
 
 import (
+	"context"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/sirupsen/logrus"
+	"github.com/slugger/mstdnlambda/internal/awssession"
+	"github.com/slugger/mstdnlambda/internal/cfg"
 	"github.com/slugger/mstdnlambda/internal/devenv"
 	"github.com/slugger/mstdnlambda/internal/logging"
+	"github.com/slugger/mstdnlambda/internal/payload"
+)
+
+// Names of the attributes attached to each Message
+const (
+	NotificationTypeAttr   = "notification_type"
+	PreferredLocaleAttr    = "preferred_locale"
+	AccessTokenPresentAttr = "access_token_present"
+	InstanceAttr           = "instance"
 )
 
+// Message is a notification to be delivered by a Notifier along with the attributes describing it
+type Message struct {
+	// Body is the content delivered to the target
+	Body string
+	// Attributes describe the notification; notifiers that support metadata deliver them alongside the body, empty values are never delivered
+	Attributes map[string]string
+	// ID uniquely identifies the notification across accounts and instances
+	ID string
+	// Account identifies the account the notification was sent to
+	Account string
+}
+
+// NewMessage builds the Message delivering body for the given notification, deriving its attributes from the notification and the instance it was received from
+func NewMessage(body string, n *payload.Notification, instance string) *Message {
+	return &Message{
+		Body: body,
+		Attributes: map[string]string{
+			NotificationTypeAttr:   n.NotificationType,
+			PreferredLocaleAttr:    n.PreferredLocale,
+			AccessTokenPresentAttr: strconv.FormatBool(n.AccessToken != ""),
+			InstanceAttr:           instance,
+		},
+		ID:      n.Key(),
+		Account: n.Account(),
+	}
+}
+
+// WithBody returns a copy of the message delivering body instead; the attributes are shared with the original message
+func (m *Message) WithBody(body string) *Message {
+	cp := *m
+	cp.Body = body
+	return &cp
+}
+
+// WithAttributes returns a copy of the message with the given attributes added to its own
+func (m *Message) WithAttributes(attrs map[string]string) *Message {
+	cp := *m
+	cp.Attributes = make(map[string]string, len(m.Attributes)+len(attrs))
+	for k, v := range m.Attributes {
+		cp.Attributes[k] = v
+	}
+	for k, v := range attrs {
+		cp.Attributes[k] = v
+	}
+	return &cp
+}
+
 // Notifier defines the contract for receivers of incoming push notifications
 type Notifier interface {
-	// Send delivers the given message string to this Notifier; returns nil on success or non-nil in case of an error
-	Send(message string) error
+	// Send delivers the given message to this Notifier; returns nil on success or non-nil in case of an error
+	Send(ctx context.Context, msg *Message) error
 }
 
-// New returns a default implementation of Notifier
+// New returns a default implementation of Notifier; when an offload location is configured, large messages are offloaded to S3
 func New(target string) Notifier {
 	if devenv.IsActive() {
 		return &devNotifier{
 			target: target,
 		}
 	}
-	return newSns(target)
+	n := newSns(target)
+	if cfg.Cfg.OffloadBucket() != "" {
+		n = NewClaimCheck(n, s3.New(awssession.Get()), cfg.Cfg.OffloadBucket(), cfg.Cfg.OffloadPrefix(), cfg.Cfg.OffloadThreshold())
+	}
+	return n
 }
 
 type devNotifier struct {
 	target string
 }
 
-var devLog *logrus.Entry
-
-func init() {
-	devLog = logging.GetLogForCategory(logging.DevEnvCategory)
-}
-
-func (n *devNotifier) Send(message string) error {
-	devLog.WithField("target", n.target).Info(message)
+func (n *devNotifier) Send(ctx context.Context, msg *Message) error {
+	logging.GetLogForContext(ctx, logging.DevEnvCategory).WithFields(logrus.Fields{"target": n.target, "attributes": msg.Attributes}).Info(payload.Redact(msg.Body))
 	return nil
 }
@@ -0,0 +1,202 @@
+package notify
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/logging"
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMessageDerivesAttributesFromNotification(t *testing.T) {
+	n := &payload.Notification{NotificationID: "1", NotificationType: "follow", PreferredLocale: "fr", AccessToken: "tok"}
+	msg := NewMessage("body", n, "mstdn.ca")
+	assert.Equal(t, "body", msg.Body)
+	assert.Equal(t, map[string]string{
+		NotificationTypeAttr:   "follow",
+		PreferredLocaleAttr:    "fr",
+		AccessTokenPresentAttr: "true",
+		InstanceAttr:           "mstdn.ca",
+	}, msg.Attributes)
+	assert.Equal(t, n.Key(), msg.ID)
+	assert.Equal(t, n.Account(), msg.Account)
+}
+
+func TestNewMessageReportsMissingAccessToken(t *testing.T) {
+	msg := NewMessage("body", &payload.Notification{NotificationType: "follow"}, "")
+	assert.Equal(t, "false", msg.Attributes[AccessTokenPresentAttr])
+}
+
+func TestWithBodyDoesNotModifyOriginal(t *testing.T) {
+	n := &payload.Notification{NotificationID: "1", NotificationType: "follow", AccessToken: "tok"}
+	orig := NewMessage("body", n, "mstdn.ca")
+	msg := orig.WithBody("other")
+	assert.Equal(t, "other", msg.Body)
+	assert.Equal(t, "body", orig.Body)
+	assert.Equal(t, orig.Attributes, msg.Attributes)
+	assert.Equal(t, orig.ID, msg.ID)
+}
+
+func TestWithAttributesDoesNotModifyOriginal(t *testing.T) {
+	n := &payload.Notification{NotificationID: "1", NotificationType: "follow", AccessToken: "tok"}
+	orig := NewMessage("body", n, "mstdn.ca")
+	msg := orig.WithAttributes(map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+	assert.Equal(t, 5, len(msg.Attributes))
+	assert.Equal(t, "follow", msg.Attributes[NotificationTypeAttr])
+	assert.Equal(t, 4, len(orig.Attributes))
+	assert.Equal(t, orig.Body, msg.Body)
+}
+
+func TestSnsAttributesDropsEmptyValues(t *testing.T) {
+	result := snsAttributes(map[string]string{NotificationTypeAttr: "mention", PreferredLocaleAttr: ""})
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, "String", *result[NotificationTypeAttr].DataType)
+	assert.Equal(t, "mention", *result[NotificationTypeAttr].StringValue)
+}
+
+func TestSnsAttributesSendsPayloadSizeAsNumber(t *testing.T) {
+	result := snsAttributes(map[string]string{NotificationTypeAttr: "mention", ExtendedPayloadSizeAttr: "300000"})
+	assert.Equal(t, "String", *result[NotificationTypeAttr].DataType)
+	assert.Equal(t, "Number", *result[ExtendedPayloadSizeAttr].DataType)
+	assert.Equal(t, "300000", *result[ExtendedPayloadSizeAttr].StringValue)
+}
+
+func TestSnsNotifierDetectsFifoTopics(t *testing.T) {
+	assert.True(t, (&snsNotifier{topicArn: "arn:aws:sns:ca-central-1:123456789012:bots.fifo"}).isFifo())
+	assert.False(t, (&snsNotifier{topicArn: "arn:aws:sns:ca-central-1:123456789012:bots"}).isFifo())
+}
+
+func TestFifoGroupID(t *testing.T) {
+	msg := NewMessage("body", &payload.Notification{NotificationID: "1", NotificationType: "mention", AccessToken: "a"}, "")
+	anonymous := &Message{Body: "body", Attributes: map[string]string{}}
+	testCases := []struct {
+		groupBy  string
+		msg      *Message
+		expected string
+		desc     string
+	}{
+		{"account", msg, msg.Account, "grouped by account"},
+		{"account", anonymous, "bots", "grouped by account without access token"},
+		{"type", msg, "mention", "grouped by type"},
+		{"type", anonymous, "bots", "grouped by type without type"},
+		{"constant", msg, "bots", "constant group"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			t.Setenv("MSTDN_PRIVATE_KEY", "key")
+			t.Setenv("MSTDN_SHARED_SECRET", "secret")
+			t.Setenv("MSTDN_FIFO_GROUP_BY", tc.groupBy)
+			t.Setenv("MSTDN_FIFO_GROUP_ID", "bots")
+			cfg.ParseConfig()
+			assert.Equal(t, tc.expected, fifoGroupID(tc.msg))
+		})
+	}
+}
+
+func TestFifoDedupIDFallsBackToBodyHash(t *testing.T) {
+	msg := NewMessage("body", &payload.Notification{NotificationID: "1", AccessToken: "a"}, "")
+	assert.Equal(t, msg.ID, fifoDedupID(msg))
+	assert.Equal(t, fifoDedupID(&Message{Body: "body"}), fifoDedupID(&Message{Body: "body"}))
+	assert.NotEqual(t, fifoDedupID(&Message{Body: "body"}), fifoDedupID(&Message{Body: "other"}))
+}
+
+func TestClassifyPublishErrors(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected error
+		desc     string
+	}{
+		{awserr.New(sns.ErrCodeThrottledException, "rate exceeded", nil), ErrThrottled, "sns throttled"},
+		{awserr.New(sns.ErrCodeKMSThrottlingException, "rate exceeded", nil), ErrThrottled, "kms throttled"},
+		{awserr.New(sns.ErrCodeInternalErrorException, "oops", nil), ErrUnavailable, "internal error"},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "bad gateway", nil), 502, "req-1"), ErrUnavailable, "5xx response"},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "slow down", nil), 429, "req-1"), ErrThrottled, "429 response"},
+		{awserr.New(sns.ErrCodeNotFoundException, "topic does not exist", nil), ErrInvalidTarget, "topic not found"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.ErrorIs(t, classify(tc.err), tc.expected)
+		})
+	}
+}
+
+func TestClassifyLeavesOtherErrorsAlone(t *testing.T) {
+	err := awserr.New(sns.ErrCodeAuthorizationErrorException, "denied", nil)
+	assert.Equal(t, err, classify(err))
+	other := errors.New("boom")
+	assert.Equal(t, other, classify(other))
+}
+
+func TestSnsClientRejectsInvalidTargets(t *testing.T) {
+	for _, target := range []string{"foobar", "arn:aws:sqs:ca-central-1:123456789012:queue", "arn:aws:sns::123456789012:topic"} {
+		_, err := snsClient(logging.Log, target)
+		assert.ErrorIs(t, err, ErrInvalidTarget, target)
+	}
+}
+
+func TestSnsClientUsesRegionOfTopic(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	cfg.ParseConfig()
+	c1, err := snsClient(logging.Log, "arn:aws:sns:us-east-1:123456789012:topic1")
+	assert.Nil(t, err)
+	c2, err := snsClient(logging.Log, "arn:aws:sns:us-east-1:123456789012:topic2")
+	assert.Nil(t, err)
+	c3, err := snsClient(logging.Log, "arn:aws:sns:eu-west-1:123456789012:topic1")
+	assert.Nil(t, err)
+
+	assert.Same(t, c1, c2)
+	assert.Equal(t, "us-east-1", *c1.(*sns.SNS).Config.Region)
+	assert.Equal(t, "eu-west-1", *c3.(*sns.SNS).Config.Region)
+}
+
+func TestSnsClientAssumesRoleConfiguredForAccount(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_SNS_ROLES", "210987654321=arn:aws:iam::210987654321:role/publisher")
+	cfg.ParseConfig()
+	own, err := snsClient(logging.Log, "arn:aws:sns:us-west-2:123456789012:topic")
+	assert.Nil(t, err)
+	other, err := snsClient(logging.Log, "arn:aws:sns:us-west-2:210987654321:topic")
+	assert.Nil(t, err)
+
+	assert.NotSame(t, own, other)
+	assert.NotSame(t, own.(*sns.SNS).Config.Credentials, other.(*sns.SNS).Config.Credentials)
+}
+
+func TestDevNotifierLogsThroughContext(t *testing.T) {
+	var out bytes.Buffer
+	origOut := logging.SetOutput(&out)
+	t.Cleanup(func() { logging.SetOutput(origOut) })
+
+	ctx := logging.NewContext(context.TODO(), logging.Log.WithField("requestId", "req-1"))
+	assert.Nil(t, (&devNotifier{target: "target1"}).Send(ctx, &Message{Body: "{}"}))
+	assert.Contains(t, out.String(), `"requestId":"req-1"`)
+}
@@ -20,51 +20,173 @@ package notify
 */
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 	"github.com/sirupsen/logrus"
+	"github.com/slugger/mstdnlambda/internal/awssession"
 	"github.com/slugger/mstdnlambda/internal/cfg"
 	"github.com/slugger/mstdnlambda/internal/logging"
 )
 
+// ErrInvalidTarget represents an error caused by a target that is not a valid SNS topic ARN
+var ErrInvalidTarget = errors.New("invalid target")
+
+// ErrThrottled represents an error caused by SNS throttling the lambda's requests
+var ErrThrottled = errors.New("sns throttled")
+
+// ErrUnavailable represents an error caused by SNS being temporarily unable to accept messages
+var ErrUnavailable = errors.New("sns unavailable")
+
 type snsNotifier struct {
 	topicArn string
 }
 
-var snsLog *logrus.Entry
-var snsSession *session.Session
+// snsClients caches one client per region and assumed role
+var snsClients = make(map[string]snsiface.SNSAPI)
+var snsClientsLock sync.Mutex
 
 func newSns(topicArn string) Notifier {
-	if snsLog == nil {
-		snsLog = logging.GetLogForCategory(logging.SnsNotificationCategory)
-		snsLog.Debug("sns log initialized")
-	}
-	if snsSession == nil {
-		snsSession = session.Must(session.NewSessionWithOptions(session.Options{
-			Config: *aws.NewConfig().WithRegion(cfg.Cfg.AwsRegion()),
-		}))
-		snsLog.WithField("awsregion", cfg.Cfg.AwsRegion()).Debugf("sns session initialized")
-	}
 	return &snsNotifier{
 		topicArn: topicArn,
 	}
 }
 
-func (n *snsNotifier) Send(message string) error {
-	log := snsLog.WithField("target", n.topicArn)
-	svc := sns.New(snsSession)
+func (n *snsNotifier) Send(ctx context.Context, msg *Message) error {
+	log := logging.GetLogForContext(ctx, logging.SnsNotificationCategory).WithField("target", n.topicArn)
+	svc, err := snsClient(log, n.topicArn)
+	if err != nil {
+		return err
+	}
 	req := sns.PublishInput{
-		TopicArn: &n.topicArn,
-		Message:  &message,
+		TopicArn:          &n.topicArn,
+		Message:           &msg.Body,
+		MessageAttributes: snsAttributes(msg.Attributes),
+	}
+	if n.isFifo() {
+		req.MessageGroupId = aws.String(fifoGroupID(msg))
+		req.MessageDeduplicationId = aws.String(fifoDedupID(msg))
+		log = log.WithField("groupId", *req.MessageGroupId)
 	}
 	resp, err := svc.Publish(&req)
 	if err == nil {
 		log.WithField("response", resp.String()).Debug("sns delivered")
 	} else {
-		err = fmt.Errorf("[sns publish failed] %w", err)
+		err = fmt.Errorf("[sns publish failed] %w", classify(err))
+	}
+	return err
+}
+
+// classify wraps err in the sentinel describing the kind of failure it represents, if known
+func classify(err error) error {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return err
+	}
+	switch aerr.Code() {
+	case sns.ErrCodeThrottledException, sns.ErrCodeKMSThrottlingException, "Throttling", "ThrottlingException", "RequestThrottled":
+		return fmt.Errorf("%w: %s", ErrThrottled, err.Error())
+	case sns.ErrCodeInternalErrorException, "ServiceUnavailable", "InternalFailure", "RequestTimeout":
+		return fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	case sns.ErrCodeNotFoundException:
+		return fmt.Errorf("%w: %s", ErrInvalidTarget, err.Error())
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch {
+		case reqErr.StatusCode() == 429:
+			return fmt.Errorf("%w: %s", ErrThrottled, err.Error())
+		case reqErr.StatusCode() >= 500:
+			return fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+		}
 	}
 	return err
 }
+
+// snsClient returns the client for the region of the given topic; topics owned by an account with a configured role are published to using that role
+func snsClient(log *logrus.Entry, topicArn string) (snsiface.SNSAPI, error) {
+	a, err := arn.Parse(topicArn)
+	if err != nil || a.Service != "sns" || a.Region == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, topicArn)
+	}
+	role := cfg.Cfg.SnsRoles()[a.AccountID]
+
+	snsClientsLock.Lock()
+	defer snsClientsLock.Unlock()
+	key := a.Region + "|" + role
+	svc, ok := snsClients[key]
+	if !ok {
+		sess := awssession.ForRegion(a.Region)
+		if role == "" {
+			svc = sns.New(sess)
+		} else {
+			svc = sns.New(sess, aws.NewConfig().WithCredentials(stscreds.NewCredentials(sess, role)))
+		}
+		snsClients[key] = svc
+		log.WithFields(logrus.Fields{"awsregion": a.Region, "role": role}).Debug("sns client initialized")
+	}
+	return svc, nil
+}
+
+// snsAttributes converts the message attributes to SNS message attributes so subscription filter policies can be applied to them; SNS rejects empty values so they are dropped
+func snsAttributes(attrs map[string]string) map[string]*sns.MessageAttributeValue {
+	result := make(map[string]*sns.MessageAttributeValue)
+	for k, v := range attrs {
+		if v == "" {
+			continue
+		}
+		result[k] = &sns.MessageAttributeValue{
+			DataType:    aws.String(attributeDataType(k)),
+			StringValue: aws.String(v),
+		}
+	}
+	return result
+}
+
+// attributeDataType returns the SNS data type of the attribute named k; the extended client libraries only recognize an ExtendedPayloadSize of type Number
+func attributeDataType(k string) string {
+	if k == ExtendedPayloadSizeAttr {
+		return "Number"
+	}
+	return "String"
+}
+
+func (n *snsNotifier) isFifo() bool {
+	return strings.HasSuffix(n.topicArn, ".fifo")
+}
+
+// fifoGroupID returns the message group for msg based on the configured grouping; messages within a group are delivered in order
+func fifoGroupID(msg *Message) string {
+	switch cfg.Cfg.FifoGroupBy() {
+	case cfg.FifoGroupByType:
+		if t := msg.Attributes[NotificationTypeAttr]; t != "" {
+			return t
+		}
+	case cfg.FifoGroupByConstant:
+	default:
+		if msg.Account != "" {
+			return msg.Account
+		}
+	}
+	return cfg.Cfg.FifoGroupID()
+}
+
+// fifoDedupID returns the deduplication id for msg; falls back to a hash of the body if the message has no ID
+func fifoDedupID(msg *Message) string {
+	if msg.ID != "" {
+		return msg.ID
+	}
+	sum := sha256.Sum256([]byte(msg.Body))
+	return hex.EncodeToString(sum[:])
+}
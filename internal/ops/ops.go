@@ -0,0 +1,155 @@
+package ops
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The ops package implements the operational endpoints of the lambda, which
+	are served under the reserved /_ path prefix instead of being treated as
+	encoded targets:
+
+	GET /_health reports whether the config loaded and the web push keys parse.
+
+	GET /_version reports the build the lambda is running.
+
+	POST /_selftest runs a synthetic notification through the full pipeline
+	without publishing it; see NewRequest.
+*/
+
+import (
+	"crypto/elliptic"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime/debug"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+)
+
+// Prefix is the path prefix reserved for the operational endpoints
+const Prefix = "/_"
+
+// Paths of the operational endpoints
+const (
+	HealthPath   = Prefix + "health"
+	VersionPath  = Prefix + "version"
+	SelfTestPath = Prefix + "selftest"
+)
+
+// ErrInvalidKey represents an error caused by a configured web push key that cannot be used
+var ErrInvalidKey = errors.New("invalid key")
+
+// sharedSecretSize is the size of the web push auth secret
+const sharedSecretSize = 16
+
+// Health is the result of the lambda's health checks; each check maps to "ok" or the reason it failed
+type Health struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// IsHealthy returns true iff all of the health checks passed
+func (h *Health) IsHealthy() bool {
+	return h.Status == "ok"
+}
+
+// CheckHealth checks that the config is loaded and the configured web push keys parse
+func CheckHealth() *Health {
+	h := &Health{Status: "ok", Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			h.Status = "fail"
+			h.Checks[name] = err.Error()
+			return
+		}
+		h.Checks[name] = "ok"
+	}
+	if cfg.Cfg == nil || cfg.Cfg.PrivateKey() == "" {
+		check("config", errors.New("config not loaded"))
+		return h
+	}
+	check("config", nil)
+	_, err := PublicKey()
+	check("private_key", err)
+	_, err = sharedSecret()
+	check("shared_secret", err)
+	return h
+}
+
+// PublicKey returns the uncompressed P-256 public key of the configured private key; this is the key Mastodon encrypts notifications with
+func PublicKey() ([]byte, error) {
+	d, err := b64.RawURLEncoding.DecodeString(cfg.Cfg.PrivateKey())
+	if err != nil {
+		return nil, fmt.Errorf("%w: private key is not base64 encoded: %s", ErrInvalidKey, err.Error())
+	}
+	curve := elliptic.P256()
+	if len(d) != 32 {
+		return nil, fmt.Errorf("%w: private key must be 32 bytes", ErrInvalidKey)
+	}
+	if k := new(big.Int).SetBytes(d); k.Sign() == 0 || k.Cmp(curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("%w: private key is not a P-256 key", ErrInvalidKey)
+	}
+	x, y := curve.ScalarBaseMult(d)
+	return elliptic.Marshal(curve, x, y), nil
+}
+
+func sharedSecret() ([]byte, error) {
+	secret, err := b64.RawURLEncoding.DecodeString(cfg.Cfg.SharedSecret())
+	if err != nil {
+		return nil, fmt.Errorf("%w: shared secret is not base64 encoded: %s", ErrInvalidKey, err.Error())
+	}
+	if len(secret) != sharedSecretSize {
+		return nil, fmt.Errorf("%w: shared secret must be %d bytes", ErrInvalidKey, sharedSecretSize)
+	}
+	return secret, nil
+}
+
+// Version describes the build of the running lambda
+type Version struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified"`
+}
+
+// BuildVersion returns the build info embedded in the binary; the fields are empty if the binary was built without module support
+func BuildVersion() *Version {
+	v := &Version{}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v.Module = info.Main.Path
+	v.Version = info.Main.Version
+	v.GoVersion = info.GoVersion
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Revision = s.Value
+		case "vcs.time":
+			v.Time = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
@@ -0,0 +1,139 @@
+package ops_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/http"
+	"github.com/slugger/mstdnlambda/internal/jwt"
+	"github.com/slugger/mstdnlambda/internal/ops"
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckHealthSucceedsWithValidKeys(t *testing.T) {
+	key := setKeys(t)
+	cfg.ParseConfig()
+
+	h := ops.CheckHealth()
+	assert.True(t, h.IsHealthy())
+	assert.Equal(t, map[string]string{"config": "ok", "private_key": "ok", "shared_secret": "ok"}, h.Checks)
+
+	pub, err := ops.PublicKey()
+	assert.Nil(t, err)
+	assert.Equal(t, elliptic.Marshal(elliptic.P256(), key.X, key.Y), pub)
+}
+
+func TestCheckHealthReportsInvalidKeys(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", base64.RawURLEncoding.EncodeToString(make([]byte, 32)))
+	t.Setenv("MSTDN_SHARED_SECRET", "not base64!")
+	cfg.ParseConfig()
+
+	h := ops.CheckHealth()
+	assert.False(t, h.IsHealthy())
+	assert.Equal(t, "fail", h.Status)
+	assert.Equal(t, "ok", h.Checks["config"])
+	assert.Contains(t, h.Checks["private_key"], "not a P-256 key")
+	assert.Contains(t, h.Checks["shared_secret"], "not base64 encoded")
+}
+
+func TestBuildVersionReportsGoVersion(t *testing.T) {
+	v := ops.BuildVersion()
+	assert.True(t, strings.HasPrefix(v.GoVersion, "go"))
+}
+
+func TestAuthorize(t *testing.T) {
+	setKeys(t)
+	cfg.ParseConfig()
+	assert.ErrorIs(t, ops.Authorize(&http.Request{}), ops.ErrSelfTestDisabled)
+
+	setKeys(t)
+	t.Setenv("MSTDN_SELFTEST_TOKEN", "s3cret")
+	cfg.ParseConfig()
+	assert.Nil(t, ops.Authorize(&http.Request{Headers: map[string]string{"authorization": "Bearer s3cret"}}))
+	assert.ErrorIs(t, ops.Authorize(&http.Request{Headers: map[string]string{"authorization": "Bearer other"}}), ops.ErrUnauthorized)
+	assert.ErrorIs(t, ops.Authorize(&http.Request{Headers: map[string]string{"authorization": "s3cret"}}), ops.ErrUnauthorized)
+	assert.ErrorIs(t, ops.Authorize(&http.Request{}), ops.ErrUnauthorized)
+}
+
+func TestNewRequestBuildsVerifiableEncryptedRequest(t *testing.T) {
+	setKeys(t)
+	cfg.ParseConfig()
+	event := &http.Request{Method: "POST", Path: ops.SelfTestPath + "/dGFyZ2V0MQ", DomainName: "push.example.com", RequestID: "req-1"}
+
+	req, err := ops.NewRequest(event)
+	assert.Nil(t, err)
+	assert.Equal(t, "/dGFyZ2V0MQ", req.Path)
+	assert.Equal(t, "req-1", req.RequestID)
+
+	targets, err := http.ExtractTargets(req)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"target1"}, targets)
+
+	vjwt, err := http.ExtractJwt(req)
+	assert.Nil(t, err)
+	assert.Nil(t, jwt.Verify(vjwt))
+
+	encrypted, err := http.ExtractPayload(req)
+	assert.Nil(t, err)
+	msg, err := payload.Decrypt(encrypted)
+	assert.Nil(t, err)
+	n, err := payload.Parse(msg)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(n.NotificationID), "selftest-"))
+}
+
+func TestReportIsNilSafe(t *testing.T) {
+	var live *ops.Report
+	live.Record("stage", nil)
+	live.Skip("stage", "why")
+	assert.False(t, live.IsDryRun())
+
+	report := ops.NewReport()
+	report.Record("one", nil)
+	report.Skip("two", "why")
+	assert.True(t, report.IsDryRun())
+	assert.True(t, report.Passed())
+	report.Record("three", assert.AnError)
+	assert.False(t, report.Passed())
+	assert.Equal(t, ops.StageFailed, report.Stages[2].Status)
+}
+
+// setKeys sets a freshly generated set of web push keys for the lambda and returns the private key; the keys are cleared once the config is parsed
+func setKeys(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	secret := make([]byte, 16)
+	if _, err = rand.Read(secret); err != nil {
+		panic(err)
+	}
+	t.Setenv("MSTDN_PRIVATE_KEY", base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))))
+	t.Setenv("MSTDN_SHARED_SECRET", base64.RawURLEncoding.EncodeToString(secret))
+	return key
+}
@@ -0,0 +1,191 @@
+package ops
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ece "github.com/crow-misia/http-ece"
+	jwtlib "github.com/dgrijalva/jwt-go/v4"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/http"
+	"github.com/slugger/mstdnlambda/internal/payload"
+)
+
+// ErrSelfTestDisabled represents an error caused by a self test requested while no self test token is configured
+var ErrSelfTestDisabled = errors.New("self test disabled")
+
+// ErrUnauthorized represents an error caused by a self test requested without the configured token
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Stage statuses reported by a self test
+const (
+	StageOK      = "ok"
+	StageFailed  = "fail"
+	StageSkipped = "skipped"
+)
+
+// Stage is the outcome of one stage of the pipeline during a self test
+type Stage struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report collects the outcome of each pipeline stage during a self test; a nil Report is a live request, for which nothing is recorded
+type Report struct {
+	Stages []Stage `json:"stages"`
+}
+
+// NewReport returns an empty self test report
+func NewReport() *Report {
+	return &Report{Stages: []Stage{}}
+}
+
+// IsDryRun returns true iff the pipeline is running a self test, in which case it must not have any side effects
+func (r *Report) IsDryRun() bool {
+	return r != nil
+}
+
+// Record records the outcome of a stage; the stage failed iff err is non-nil
+func (r *Report) Record(name string, err error) {
+	if r == nil {
+		return
+	}
+	if err != nil {
+		r.Stages = append(r.Stages, Stage{Name: name, Status: StageFailed, Detail: err.Error()})
+		return
+	}
+	r.Stages = append(r.Stages, Stage{Name: name, Status: StageOK})
+}
+
+// Note records a stage that succeeded with the given detail
+func (r *Report) Note(name string, detail string) {
+	if r == nil {
+		return
+	}
+	r.Stages = append(r.Stages, Stage{Name: name, Status: StageOK, Detail: detail})
+}
+
+// Skip records a stage that was not run and why
+func (r *Report) Skip(name string, reason string) {
+	if r == nil {
+		return
+	}
+	r.Stages = append(r.Stages, Stage{Name: name, Status: StageSkipped, Detail: reason})
+}
+
+// Passed returns true iff no stage failed
+func (r *Report) Passed() bool {
+	for _, s := range r.Stages {
+		if s.Status == StageFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Authorize checks the authorization header of a self test request against the configured token
+func Authorize(event *http.Request) error {
+	token := cfg.Cfg.SelfTestToken()
+	if token == "" {
+		return ErrSelfTestDisabled
+	}
+	hdr := event.Headers["authorization"]
+	if !strings.HasPrefix(hdr, "Bearer ") || subtle.ConstantTimeCompare([]byte(hdr[len("Bearer "):]), []byte(token)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// selfTestMessage is the synthetic notification sent through the pipeline; it is a valid Mastodon notification so every stage can be exercised
+const selfTestMessage = `{"notification_id":%q,"notification_type":"mention","title":"mstdnlambda self test","body":"This notification was generated by a self test and was not published.","access_token":"selftest","preferred_locale":"en"}`
+
+// NewRequest builds the push request a Mastodon instance would send for a synthetic notification: it is encrypted for the configured keys and carries a JWT signed by a throwaway VAPID key for the audience event was sent to; the targets are the path segments following the self test path
+func NewRequest(event *http.Request) (*http.Request, error) {
+	publicKey, err := PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret()
+	if err != nil {
+		return nil, err
+	}
+	sender, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	senderPublic := elliptic.Marshal(elliptic.P256(), sender.X, sender.Y)
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	id := fmt.Sprintf("selftest-%d", time.Now().UnixNano())
+	data, err := ece.Encrypt([]byte(fmt.Sprintf(selfTestMessage, id)),
+		ece.WithEncoding(ece.AESGCM),
+		ece.WithPrivate(sender.D.FillBytes(make([]byte, 32))),
+		ece.WithDh(publicKey),
+		ece.WithAuthSecret(secret),
+		ece.WithSalt(salt))
+	if err != nil {
+		return nil, fmt.Errorf("[self test encrypt failed] %w", err)
+	}
+
+	aud := fmt.Sprintf("https://%s", event.DomainName)
+	if configured := cfg.Cfg.Audiences(); len(configured) > 0 {
+		aud = configured[0]
+	}
+	token, err := jwtlib.NewWithClaims(jwtlib.SigningMethodES256, jwtlib.MapClaims{
+		"aud": aud,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"sub": "mailto:selftest@localhost",
+	}).SignedString(sender)
+	if err != nil {
+		return nil, fmt.Errorf("[self test jwt sign failed] %w", err)
+	}
+
+	enc := b64.RawURLEncoding.EncodeToString
+	return &http.Request{
+		Source: event.Source,
+		Method: event.Method,
+		Path:   strings.TrimPrefix(event.Path, SelfTestPath),
+		Headers: map[string]string{
+			"authorization":    "WebPush " + token,
+			"crypto-key":       fmt.Sprintf("dh=%s;p256ecdsa=%s", enc(senderPublic), enc(senderPublic)),
+			"encryption":       fmt.Sprintf("salt=%s", enc(salt)),
+			"content-encoding": payload.Encoding,
+			"content-type":     "application/octet-stream",
+		},
+		Body:            b64.StdEncoding.EncodeToString(data),
+		IsBase64Encoded: true,
+		DomainName:      event.DomainName,
+		RequestID:       event.RequestID,
+		SourceIP:        event.SourceIP,
+	}, nil
+}
@@ -0,0 +1,125 @@
+package payload
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// ErrInvalidNotification represents an error caused by decrypted content that is not a valid Mastodon push notification
+var ErrInvalidNotification = errors.New("invalid notification")
+
+// notificationTypePattern matches the notification types Mastodon sends, i.e. mention or admin.sign_up
+var notificationTypePattern = regexp.MustCompile(`^[a-z][a-z_]*(\.[a-z_]+)*$`)
+
+// NotificationID is the id of a Mastodon notification; Mastodon has sent it as both a JSON number and a JSON string so either is accepted
+type NotificationID string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (id *NotificationID) UnmarshalJSON(data []byte) error {
+	var num json.Number
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&num); err == nil {
+		*id = NotificationID(num.String())
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("notification_id must be a string or number: %w", err)
+	}
+	*id = NotificationID(str)
+	return nil
+}
+
+// Notification is the decrypted JSON document Mastodon sends in a push notification
+type Notification struct {
+	AccessToken      string         `json:"access_token"`
+	PreferredLocale  string         `json:"preferred_locale"`
+	NotificationID   NotificationID `json:"notification_id"`
+	NotificationType string         `json:"notification_type"`
+	Icon             string         `json:"icon"`
+	Title            string         `json:"title"`
+	Body             string         `json:"body"`
+	document         interface{}
+}
+
+// Parse parses and validates the given decrypted notification; returns an error wrapping ErrInvalidNotification if the content is not a valid Mastodon push notification
+func Parse(msg string) (*Notification, error) {
+	var n Notification
+	if err := json.Unmarshal([]byte(msg), &n); err != nil {
+		return nil, fmt.Errorf("[notification unmarshal failed] %w: %s", ErrInvalidNotification, err.Error())
+	}
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(msg), &n.document); err != nil {
+		return nil, fmt.Errorf("[notification unmarshal failed] %w: %s", ErrInvalidNotification, err.Error())
+	}
+	return &n, nil
+}
+
+// Document returns the decrypted notification as generic JSON values, including any fields not modelled by Notification
+func (n *Notification) Document() interface{} {
+	return n.document
+}
+
+func (n *Notification) validate() error {
+	if n.NotificationID == "" {
+		return fmt.Errorf("%w: notification_id is required", ErrInvalidNotification)
+	}
+	if !notificationTypePattern.MatchString(n.NotificationType) {
+		return fmt.Errorf("%w: invalid notification_type '%s'", ErrInvalidNotification, n.NotificationType)
+	}
+	if n.AccessToken == "" {
+		return fmt.Errorf("%w: access_token is required", ErrInvalidNotification)
+	}
+	if n.Title == "" {
+		return fmt.Errorf("%w: title is required", ErrInvalidNotification)
+	}
+	if n.Icon != "" {
+		if u, err := url.Parse(n.Icon); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%w: icon must be an absolute url", ErrInvalidNotification)
+		}
+	}
+	return nil
+}
+
+// Key uniquely identifies the notification across accounts and instances; notification ids are only unique per instance so the access token is included
+func (n *Notification) Key() string {
+	return hash(n.AccessToken + "|" + string(n.NotificationID))
+}
+
+// Account identifies the account the notification was sent to without revealing its access token
+func (n *Notification) Account() string {
+	return hash(n.AccessToken)
+}
+
+func hash(val string) string {
+	sum := sha256.Sum256([]byte(val))
+	return hex.EncodeToString(sum[:])
+}
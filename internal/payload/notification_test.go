@@ -0,0 +1,115 @@
+package payload_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"testing"
+
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/stretchr/testify/assert"
+)
+
+const validNotification = `{"access_token":"tok","preferred_locale":"en","notification_id":12345,"notification_type":"mention","icon":"https://files.mstdn.ca/avatar.png","title":"You were mentioned by foo","body":"hello world"}`
+
+func TestParseSucceeds(t *testing.T) {
+	n, err := payload.Parse(validNotification)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "tok", n.AccessToken)
+		assert.Equal(t, "en", n.PreferredLocale)
+		assert.Equal(t, payload.NotificationID("12345"), n.NotificationID)
+		assert.Equal(t, "mention", n.NotificationType)
+		assert.Equal(t, "https://files.mstdn.ca/avatar.png", n.Icon)
+		assert.Equal(t, "You were mentioned by foo", n.Title)
+		assert.Equal(t, "hello world", n.Body)
+	}
+}
+
+func TestParseAcceptsValidVariations(t *testing.T) {
+	testCases := []struct {
+		input string
+		desc  string
+	}{
+		{`{"access_token":"tok","notification_id":"12345","notification_type":"mention","title":"t"}`, "string notification_id"},
+		{`{"access_token":"tok","notification_id":1,"notification_type":"admin.sign_up","title":"t"}`, "namespaced notification_type"},
+		{`{"access_token":"tok","notification_id":1,"notification_type":"follow_request","title":"t","preferred_locale":null,"body":""}`, "null locale and empty body"},
+		{`{"access_token":"tok","notification_id":1,"notification_type":"mention","title":"t","future_field":true}`, "unknown fields"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := payload.Parse(tc.input)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestParseRejectsInvalidNotifications(t *testing.T) {
+	testCases := []struct {
+		input string
+		desc  string
+	}{
+		{"hello world", "not json"},
+		{`["mention"]`, "not an object"},
+		{`{"access_token":"tok","notification_type":"mention","title":"t"}`, "missing notification_id"},
+		{`{"access_token":"tok","notification_id":null,"notification_type":"mention","title":"t"}`, "null notification_id"},
+		{`{"access_token":"tok","notification_id":{},"notification_type":"mention","title":"t"}`, "object notification_id"},
+		{`{"access_token":"tok","notification_id":1,"title":"t"}`, "missing notification_type"},
+		{`{"access_token":"tok","notification_id":1,"notification_type":"<script>","title":"t"}`, "invalid notification_type"},
+		{`{"notification_id":1,"notification_type":"mention","title":"t"}`, "missing access_token"},
+		{`{"access_token":"tok","notification_id":1,"notification_type":"mention"}`, "missing title"},
+		{`{"access_token":"tok","notification_id":1,"notification_type":"mention","title":"t","icon":"avatar.png"}`, "relative icon"},
+		{`{"access_token":"tok","notification_id":1,"notification_type":"mention","title":5}`, "title of wrong type"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := payload.Parse(tc.input)
+			assert.ErrorIs(t, err, payload.ErrInvalidNotification)
+		})
+	}
+}
+
+func TestKeyDependsOnNotificationIDAndAccessToken(t *testing.T) {
+	n1 := &payload.Notification{NotificationID: "1", AccessToken: "a", Title: "foo"}
+	n2 := &payload.Notification{NotificationID: "1", AccessToken: "a", Title: "bar"}
+	n3 := &payload.Notification{NotificationID: "1", AccessToken: "b", Title: "foo"}
+	n4 := &payload.Notification{NotificationID: "2", AccessToken: "a", Title: "foo"}
+
+	assert.Equal(t, n1.Key(), n2.Key())
+	assert.NotEqual(t, n1.Key(), n3.Key())
+	assert.NotEqual(t, n1.Key(), n4.Key())
+}
+
+func TestAccountDoesNotRevealAccessToken(t *testing.T) {
+	n := &payload.Notification{AccessToken: "secret-token"}
+	assert.NotEmpty(t, n.Account())
+	assert.NotContains(t, n.Account(), "secret-token")
+	assert.Equal(t, n.Account(), (&payload.Notification{AccessToken: "secret-token", NotificationID: "2"}).Account())
+}
+
+func TestDocumentIncludesUnmodelledFields(t *testing.T) {
+	n, err := payload.Parse(`{"access_token":"tok","notification_id":1,"notification_type":"mention","title":"t","future_field":true}`)
+	assert.Nil(t, err)
+	doc, ok := n.Document().(map[string]interface{})
+	if assert.True(t, ok) {
+		assert.Equal(t, true, doc["future_field"])
+		assert.Equal(t, "mention", doc["notification_type"])
+	}
+}
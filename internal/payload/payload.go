@@ -20,30 +20,43 @@ package payload
 */
 
 import (
+	"errors"
 	"fmt"
 
 	ece "github.com/crow-misia/http-ece"
 )
 
+// Encoding is the web push content encoding of the payloads that Decrypt supports
+const Encoding = "aesgcm"
+
+// ErrDecryptFailure represents an error caused by a payload that could not be decrypted with the configured keys
+var ErrDecryptFailure = errors.New("payload decrypt failed")
+
 // EncryptedPayload represents the encrypted push notification received from Mastodon, including all of the keys and other data required to decrypt the message
 type EncryptedPayload struct {
 	SharedSecret   []byte
 	MyPrivateKey   []byte
 	TheirPublicKey []byte
 	Salt           []byte
+	RecordSize     uint32
 	Data           []byte
 }
 
 // Decrypt decrypts the given encrypted payload returning the plaintext result iff error is nil; if error is non-nil it represents the reason the ciphertext could not be decrypted
 func Decrypt(payload *EncryptedPayload) (string, error) {
-	cleartxt, err := ece.Decrypt(payload.Data,
+	opts := []ece.Option{
 		ece.WithPrivate(payload.MyPrivateKey),
 		ece.WithAuthSecret(payload.SharedSecret),
 		ece.WithDh(payload.TheirPublicKey),
 		ece.WithEncoding(ece.AESGCM),
-		ece.WithSalt(payload.Salt))
+		ece.WithSalt(payload.Salt),
+	}
+	if payload.RecordSize != 0 {
+		opts = append(opts, ece.WithRecordSize(payload.RecordSize))
+	}
+	cleartxt, err := ece.Decrypt(payload.Data, opts...)
 	if err != nil {
-		return "", fmt.Errorf("%s: %w", "payload decrypt failed", err)
+		return "", fmt.Errorf("%w: %s", ErrDecryptFailure, err.Error())
 	}
 	return string(cleartxt), nil
 }
@@ -0,0 +1,76 @@
+package payload
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RedactedAccessToken replaces the access_token of notifications written to the logs
+const RedactedAccessToken = "[REDACTED]"
+
+// AccessTokenHashPrefix marks an access_token replaced by the hash of the token (see Notification.Account); the hash identifies the account but cannot be resolved back to the token, so it is never redacted
+const AccessTokenHashPrefix = "hash:"
+
+// accessTokenPattern matches the access_token member of a JSON document, even one that is not valid JSON as a whole
+var accessTokenPattern = regexp.MustCompile(`("access_token"\s*:\s*)"((?:[^"\\]|\\.)*)"`)
+
+// Redact returns msg with the value of its access_token replaced by RedactedAccessToken; use it whenever a notification is logged or stored
+func Redact(msg string) string {
+	return accessTokenPattern.ReplaceAllStringFunc(msg, func(member string) string {
+		groups := accessTokenPattern.FindStringSubmatch(member)
+		if strings.HasPrefix(groups[2], AccessTokenHashPrefix) {
+			return member
+		}
+		return groups[1] + `"` + RedactedAccessToken + `"`
+	})
+}
+
+// WithAccessToken returns a copy of the notification parsed from msg with its access_token replaced by token, along with the matching copy of msg; the access_token is removed entirely when token is empty
+func (n *Notification) WithAccessToken(msg string, token string) (*Notification, string, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(msg), &doc); err != nil {
+		return nil, "", fmt.Errorf("[notification unmarshal failed] %w: %s", ErrInvalidNotification, err.Error())
+	}
+	if token == "" {
+		delete(doc, "access_token")
+	} else {
+		enc, err := json.Marshal(token)
+		if err != nil {
+			return nil, "", fmt.Errorf("[access token marshal failed] %w", err)
+		}
+		doc["access_token"] = enc
+	}
+	enc, err := json.Marshal(doc)
+	if err != nil {
+		return nil, "", fmt.Errorf("[notification marshal failed] %w", err)
+	}
+
+	cp := *n
+	cp.AccessToken = token
+	cp.document = nil
+	if err = json.Unmarshal(enc, &cp.document); err != nil {
+		return nil, "", fmt.Errorf("[notification unmarshal failed] %w: %s", ErrInvalidNotification, err.Error())
+	}
+	return &cp, string(enc), nil
+}
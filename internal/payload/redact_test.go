@@ -0,0 +1,69 @@
+package payload_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"testing"
+
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactReplacesAccessToken(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+		desc     string
+	}{
+		{`{"access_token":"secret","title":"t"}`, `{"access_token":"[REDACTED]","title":"t"}`, "compact json"},
+		{`{"title":"t", "access_token" : "secret"}`, `{"title":"t", "access_token" : "[REDACTED]"}`, "whitespace"},
+		{`{"access_token":"sec\"ret","title":"t"}`, `{"access_token":"[REDACTED]","title":"t"}`, "escaped quote"},
+		{`{"access_token":"secret","title":`, `{"access_token":"[REDACTED]","title":`, "truncated json"},
+		{`{"title":"t"}`, `{"title":"t"}`, "no access token"},
+		{`{"access_token":"hash:abc","title":"t"}`, `{"access_token":"hash:abc","title":"t"}`, "hash"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, payload.Redact(tc.input))
+		})
+	}
+}
+
+func TestWithAccessToken(t *testing.T) {
+	msg := `{"access_token":"secret","notification_id":103526785146438571,"notification_type":"mention","title":"t"}`
+	n, err := payload.Parse(msg)
+	assert.Nil(t, err)
+
+	hashed, hashedMsg, err := n.WithAccessToken(msg, "hash:123")
+	assert.Nil(t, err)
+	assert.Equal(t, "hash:123", hashed.AccessToken)
+	assert.JSONEq(t, `{"access_token":"hash:123","notification_id":103526785146438571,"notification_type":"mention","title":"t"}`, hashedMsg)
+	assert.Equal(t, "hash:123", hashed.Document().(map[string]interface{})["access_token"])
+
+	dropped, droppedMsg, err := n.WithAccessToken(msg, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", dropped.AccessToken)
+	assert.NotContains(t, droppedMsg, "access_token")
+	assert.NotContains(t, dropped.Document(), "access_token")
+
+	assert.Equal(t, "secret", n.AccessToken)
+	assert.Equal(t, "secret", n.Document().(map[string]interface{})["access_token"])
+}
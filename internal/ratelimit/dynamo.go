@@ -0,0 +1,134 @@
+package ratelimit
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/sirupsen/logrus"
+	"github.com/slugger/mstdnlambda/internal/awssession"
+	"github.com/slugger/mstdnlambda/internal/logging"
+)
+
+// DynamoDB attribute names used by the rate limit table; the table must use id as its partition key
+const (
+	idAttr      = "id"
+	tokensAttr  = "tokens"
+	updatedAttr = "updated"
+	expiresAttr = "expires"
+)
+
+// maxAttempts is how many times a take is attempted when other lambda instances keep updating the same bucket
+const maxAttempts = 3
+
+type dynamoStore struct {
+	table string
+	svc   dynamodbiface.DynamoDBAPI
+}
+
+func newDynamo(table string) Store {
+	return NewDynamo(dynamodb.New(awssession.Get()), table)
+}
+
+// NewDynamo returns a Store backed by the given DynamoDB table; buckets are updated with optimistic locking so concurrent lambda instances share them and are written with an expires attribute suitable for use as the table's TTL attribute
+func NewDynamo(svc dynamodbiface.DynamoDBAPI, table string) Store {
+	return &dynamoStore{
+		table: table,
+		svc:   svc,
+	}
+}
+
+func (s *dynamoStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	for i := 0; i < maxAttempts; i++ {
+		ok, err := s.take(ctx, key, rate, burst)
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("[rate limit take failed] %w: %s", ErrStoreFailure, err.Error())
+		}
+		return ok, nil
+	}
+	return false, fmt.Errorf("[rate limit take failed] %w: bucket contended", ErrStoreFailure)
+}
+
+// take makes a single attempt at taking a token; the write fails with a conditional check failure if the bucket was updated since it was read
+func (s *dynamoStore) take(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	resp, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{idAttr: {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	tokens := float64(burst)
+	var prev *dynamodb.AttributeValue
+	if attr, ok := resp.Item[updatedAttr]; ok && attr.N != nil {
+		prev = attr
+		updated, err := strconv.ParseInt(*attr.N, 10, 64)
+		if err != nil {
+			return false, err
+		}
+		if attr, ok := resp.Item[tokensAttr]; ok && attr.N != nil {
+			if tokens, err = strconv.ParseFloat(*attr.N, 64); err != nil {
+				return false, err
+			}
+		}
+		tokens = refill(tokens, time.Unix(0, updated), now, rate, burst)
+	}
+	if tokens < 1 {
+		return false, nil
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			idAttr:      {S: aws.String(key)},
+			tokensAttr:  {N: aws.String(strconv.FormatFloat(tokens-1, 'f', -1, 64))},
+			updatedAttr: {N: aws.String(strconv.FormatInt(now.UnixNano(), 10))},
+			expiresAttr: {N: aws.String(strconv.FormatInt(now.Add(fullAfter(rate, burst)).Unix()+1, 10))},
+		},
+	}
+	if prev == nil {
+		input.ConditionExpression = aws.String("attribute_not_exists(#id)")
+		input.ExpressionAttributeNames = map[string]*string{"#id": aws.String(idAttr)}
+	} else {
+		input.ConditionExpression = aws.String("#updated = :updated")
+		input.ExpressionAttributeNames = map[string]*string{"#updated": aws.String(updatedAttr)}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":updated": prev}
+	}
+	if _, err = s.svc.PutItem(input); err != nil {
+		return false, err
+	}
+	logging.GetLogForContext(ctx, logging.RateLimitCategory).WithFields(logrus.Fields{"key": key, "tokens": tokens - 1}).Debug("token taken")
+	return true, nil
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The ratelimit package limits the rate of push requests accepted from each
+	source with a token bucket: every source has a bucket holding up to
+	MSTDN_RATE_BURST tokens that refills at MSTDN_RATE_LIMIT tokens per second
+	and each request takes one token. Buckets are kept in a pluggable Store; a
+	DynamoDB table enforces the limit across lambda instances.
+*/
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/devenv"
+)
+
+// ErrRateLimited represents an error caused by a source that sent more requests than its rate limit allows
+var ErrRateLimited = errors.New("rate limited")
+
+// ErrStoreFailure represents an error caused by a failure reading from or writing to the backing store of a Store
+var ErrStoreFailure = errors.New("rate limit store failure")
+
+// Store defines the contract for keeping the token buckets of each source
+type Store interface {
+	// Take removes a token from the bucket of key, which refills at rate tokens per second up to burst tokens; returns false if the bucket is empty
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, error)
+}
+
+// Limiter applies the configured rate limit to each source
+type Limiter struct {
+	store Store
+	rate  float64
+	burst int
+}
+
+// New returns the Limiter selected by the lambda configuration; nil if rate limiting is disabled. A DynamoDB table is used when one is configured otherwise buckets are only kept in memory
+func New() *Limiter {
+	if cfg.Cfg.RateLimit() <= 0 {
+		return nil
+	}
+	var store Store
+	if devenv.IsActive() || cfg.Cfg.RateLimitTable() == "" {
+		store = NewMemory()
+	} else {
+		store = newDynamo(cfg.Cfg.RateLimitTable())
+	}
+	return NewLimiter(store, cfg.Cfg.RateLimit(), cfg.Cfg.RateBurst())
+}
+
+// NewLimiter returns a Limiter keeping its buckets in store
+func NewLimiter(store Store, rate float64, burst int) *Limiter {
+	return &Limiter{
+		store: store,
+		rate:  rate,
+		burst: burst,
+	}
+}
+
+// Allow returns true if a request from source is within its rate limit; a nil Limiter allows everything
+func (l *Limiter) Allow(ctx context.Context, source string) (bool, error) {
+	if l == nil {
+		return true, nil
+	}
+	return l.store.Take(ctx, source, l.rate, l.burst)
+}
+
+// refill returns the tokens in a bucket that held tokens at last once it has refilled until now
+func refill(tokens float64, last time.Time, now time.Time, rate float64, burst int) float64 {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens += elapsed * rate
+	}
+	return math.Min(tokens, float64(burst))
+}
+
+// fullAfter returns how long an empty bucket takes to refill; a bucket untouched for that long is the same as a new one and can be forgotten
+func fullAfter(rate float64, burst int) time.Duration {
+	return time.Duration(float64(burst) / rate * float64(time.Second))
+}
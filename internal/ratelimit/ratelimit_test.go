@@ -0,0 +1,172 @@
+package ratelimit_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/slugger/mstdnlambda/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNilLimiterAllowsEverything(t *testing.T) {
+	var sut *ratelimit.Limiter
+	allowed, err := sut.Allow(context.Background(), "mstdn.ca")
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+}
+
+func TestMemoryStoreEnforcesBurstPerSource(t *testing.T) {
+	sut := ratelimit.NewLimiter(ratelimit.NewMemory(), 0.001, 2)
+	for i := 0; i < 2; i++ {
+		allowed, err := sut.Allow(context.Background(), "mstdn.ca")
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, err := sut.Allow(context.Background(), "mstdn.ca")
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = sut.Allow(context.Background(), "other.example")
+	assert.Nil(t, err)
+	assert.True(t, allowed, "each source has its own bucket")
+}
+
+func TestMemoryStoreRefillsBuckets(t *testing.T) {
+	sut := ratelimit.NewLimiter(ratelimit.NewMemory(), 100, 1)
+	allowed, _ := sut.Allow(context.Background(), "mstdn.ca")
+	assert.True(t, allowed)
+	allowed, _ = sut.Allow(context.Background(), "mstdn.ca")
+	assert.False(t, allowed)
+
+	time.Sleep(20 * time.Millisecond)
+	allowed, _ = sut.Allow(context.Background(), "mstdn.ca")
+	assert.True(t, allowed)
+}
+
+func TestDynamoStoreCreatesBucket(t *testing.T) {
+	svc := &mockDynamo{}
+	sut := ratelimit.NewDynamo(svc, "ratelimit")
+
+	allowed, err := sut.Take(context.Background(), "mstdn.ca", 1, 5)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	if assert.Equal(t, 1, len(svc.puts)) {
+		put := svc.puts[0]
+		assert.Equal(t, "mstdn.ca", *put.Item["id"].S)
+		assert.Equal(t, "4", *put.Item["tokens"].N)
+		assert.Equal(t, "attribute_not_exists(#id)", *put.ConditionExpression)
+		expires, err := strconv.ParseInt(*put.Item["expires"].N, 10, 64)
+		assert.Nil(t, err)
+		assert.Greater(t, expires, time.Now().Unix())
+	}
+}
+
+func TestDynamoStoreRefillsAndLocksExistingBucket(t *testing.T) {
+	updated := strconv.FormatInt(time.Now().Add(-2*time.Second).UnixNano(), 10)
+	svc := &mockDynamo{item: map[string]*dynamodb.AttributeValue{
+		"id":      {S: aws.String("mstdn.ca")},
+		"tokens":  {N: aws.String("0")},
+		"updated": {N: aws.String(updated)},
+	}}
+	sut := ratelimit.NewDynamo(svc, "ratelimit")
+
+	allowed, err := sut.Take(context.Background(), "mstdn.ca", 1, 5)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	if assert.Equal(t, 1, len(svc.puts)) {
+		put := svc.puts[0]
+		tokens, err := strconv.ParseFloat(*put.Item["tokens"].N, 64)
+		assert.Nil(t, err)
+		assert.InDelta(t, 1, tokens, 0.1)
+		assert.Equal(t, "#updated = :updated", *put.ConditionExpression)
+		assert.Equal(t, updated, *put.ExpressionAttributeValues[":updated"].N)
+	}
+}
+
+func TestDynamoStoreDeniesEmptyBucketWithoutWriting(t *testing.T) {
+	svc := &mockDynamo{item: map[string]*dynamodb.AttributeValue{
+		"tokens":  {N: aws.String("0")},
+		"updated": {N: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10))},
+	}}
+	sut := ratelimit.NewDynamo(svc, "ratelimit")
+
+	allowed, err := sut.Take(context.Background(), "mstdn.ca", 0.001, 5)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 0, len(svc.puts))
+}
+
+func TestDynamoStoreRetriesContendedBuckets(t *testing.T) {
+	svc := &mockDynamo{putErrs: []error{awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "updated", nil)}}
+	sut := ratelimit.NewDynamo(svc, "ratelimit")
+
+	allowed, err := sut.Take(context.Background(), "mstdn.ca", 1, 5)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 2, len(svc.puts))
+
+	svc = &mockDynamo{putErrs: []error{
+		awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "updated", nil),
+		awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "updated", nil),
+		awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "updated", nil),
+	}}
+	_, err = ratelimit.NewDynamo(svc, "ratelimit").Take(context.Background(), "mstdn.ca", 1, 5)
+	assert.ErrorIs(t, err, ratelimit.ErrStoreFailure)
+}
+
+func TestDynamoStoreWrapsStoreFailures(t *testing.T) {
+	sut := ratelimit.NewDynamo(&mockDynamo{err: errors.New("boom")}, "ratelimit")
+	_, err := sut.Take(context.Background(), "mstdn.ca", 1, 5)
+	assert.ErrorIs(t, err, ratelimit.ErrStoreFailure)
+}
+
+type mockDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	item    map[string]*dynamodb.AttributeValue
+	puts    []*dynamodb.PutItemInput
+	putErrs []error
+	err     error
+}
+
+func (m *mockDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &dynamodb.GetItemOutput{Item: m.item}, nil
+}
+
+func (m *mockDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.puts = append(m.puts, input)
+	if len(m.putErrs) > 0 {
+		err := m.putErrs[0]
+		m.putErrs = m.putErrs[1:]
+		return nil, err
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
@@ -0,0 +1,258 @@
+package rules
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The rules package holds the per target delivery rules configured via
+	MSTDN_TARGET_CONFIG. The setting is a JSON object keyed by target ARN; the
+	special key "*" applies to every target without an entry of its own.
+
+	Example:
+	{
+		"arn:aws:sns:ca-central-1:123456789012:bot": {"filter": "contains(['mention', 'follow'], notification_type)"},
+		"arn:aws:sns:ca-central-1:123456789012:slack": {"template": "{{.Notification.Title}}: {{.Notification.Body}}"},
+		"*": {}
+	}
+
+	A filter is a JMESPath expression evaluated against the decrypted
+	notification; the notification is only delivered to the target if the
+	result is truthy according to the JMESPath spec (i.e. not false, null or an
+	empty string, array or object).
+
+	A template is a Go text/template that renders the body published to the
+	target; it is executed with a TemplateData value. Targets without a
+	template receive the decrypted notification as is.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/payload"
+)
+
+// DefaultTarget is the key of the rule applied to targets without a rule of their own
+const DefaultTarget = "*"
+
+// Supported access_token policies
+const (
+	AccessTokenKeep = "keep"
+	AccessTokenDrop = "drop"
+	AccessTokenHash = "hash"
+)
+
+// ErrInvalidRule represents an error caused by a target rule that cannot be parsed or compiled
+var ErrInvalidRule = errors.New("invalid target rule")
+
+// ErrFilterFailure represents an error caused by a filter that could not be evaluated against a notification
+var ErrFilterFailure = errors.New("filter evaluation failed")
+
+// ErrTemplateFailure represents an error caused by a template that could not be executed for a notification
+var ErrTemplateFailure = errors.New("template execution failed")
+
+// TemplateData is the value templates are executed with
+type TemplateData struct {
+	// Notification is the parsed notification
+	Notification *payload.Notification
+	// Document is the notification as generic JSON values, including fields not modelled by Notification
+	Document interface{}
+	// Raw is the decrypted notification exactly as received
+	Raw string
+	// Instance is the domain of the Mastodon instance that sent the notification; empty if unknown
+	Instance string
+	// ReceivedAt is the time the lambda received the notification
+	ReceivedAt time.Time
+}
+
+// templateFuncs are the functions available to templates in addition to the text/template builtins
+var templateFuncs = template.FuncMap{
+	"json": toJSON,
+}
+
+// Rule is the compiled set of delivery rules for a single target
+type Rule struct {
+	filter      *jmespath.JMESPath
+	filterSrc   string
+	template    *template.Template
+	envelope    bool
+	accessToken string
+}
+
+// Rules is the compiled set of delivery rules for all targets
+type Rules struct {
+	targets map[string]*Rule
+}
+
+type ruleConfig struct {
+	Filter      string `json:"filter"`
+	Template    string `json:"template"`
+	Envelope    bool   `json:"envelope"`
+	AccessToken string `json:"access_token"`
+}
+
+// New compiles the rules configured for the lambda; nil is returned if no rules are configured
+func New() (*Rules, error) {
+	if cfg.Cfg.TargetConfig() == "" {
+		return nil, nil
+	}
+	return Parse(cfg.Cfg.TargetConfig())
+}
+
+// Parse compiles the given JSON target config; all expressions are compiled up front so mistakes are reported when the lambda starts rather than per request
+func Parse(config string) (*Rules, error) {
+	var raw map[string]ruleConfig
+	if err := json.Unmarshal([]byte(config), &raw); err != nil {
+		return nil, fmt.Errorf("%w: target config must be a JSON object keyed by target: %s", ErrInvalidRule, err.Error())
+	}
+
+	rules := &Rules{targets: make(map[string]*Rule)}
+	for target, rc := range raw {
+		rule := &Rule{filterSrc: rc.Filter, envelope: rc.Envelope, accessToken: rc.AccessToken}
+		switch rc.AccessToken {
+		case "":
+			rule.accessToken = AccessTokenKeep
+		case AccessTokenKeep, AccessTokenDrop, AccessTokenHash:
+		default:
+			return nil, fmt.Errorf("%w: access_token policy for '%s' must be one of %s, %s or %s", ErrInvalidRule, target, AccessTokenKeep, AccessTokenDrop, AccessTokenHash)
+		}
+		if rc.Filter != "" {
+			filter, err := jmespath.Compile(rc.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("%w: filter for '%s': %s", ErrInvalidRule, target, err.Error())
+			}
+			rule.filter = filter
+		}
+		if rc.Template != "" {
+			tmpl, err := template.New(target).Option("missingkey=error").Funcs(templateFuncs).Parse(rc.Template)
+			if err != nil {
+				return nil, fmt.Errorf("%w: template for '%s': %s", ErrInvalidRule, target, err.Error())
+			}
+			rule.template = tmpl
+		}
+		rules.targets[target] = rule
+	}
+	return rules, nil
+}
+
+// For returns the rule for target, falling back to the default rule; returns nil if neither exists
+func (r *Rules) For(target string) *Rule {
+	if r == nil {
+		return nil
+	}
+	if rule, ok := r.targets[target]; ok {
+		return rule
+	}
+	return r.targets[DefaultTarget]
+}
+
+// Matches returns true if the notification document passes the rule's filter; a nil rule or a rule without a filter matches everything
+func (r *Rule) Matches(doc interface{}) (bool, error) {
+	if r == nil || r.filter == nil {
+		return true, nil
+	}
+	result, err := r.filter.Search(doc)
+	if err != nil {
+		return false, fmt.Errorf("%w: '%s': %s", ErrFilterFailure, r.filterSrc, err.Error())
+	}
+	return isTruthy(result), nil
+}
+
+// Render returns the body to publish to the target after applying its access_token policy; the raw notification is returned if the rule has no template
+func (r *Rule) Render(data *TemplateData) (string, error) {
+	data, err := r.applyAccessTokenPolicy(data)
+	if err != nil {
+		return "", err
+	}
+	if r == nil || r.template == nil {
+		return data.Raw, nil
+	}
+	var sb strings.Builder
+	if err := r.template.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrTemplateFailure, err.Error())
+	}
+	return sb.String(), nil
+}
+
+// Raw returns the raw notification with the target's access_token policy applied, i.e. to be stored when delivery to the target fails
+func (r *Rule) Raw(data *TemplateData) (string, error) {
+	data, err := r.applyAccessTokenPolicy(data)
+	if err != nil {
+		return "", err
+	}
+	return data.Raw, nil
+}
+
+// applyAccessTokenPolicy returns data with the access_token dropped or replaced as required by the rule
+func (r *Rule) applyAccessTokenPolicy(data *TemplateData) (*TemplateData, error) {
+	if r == nil || r.accessToken == AccessTokenKeep {
+		return data, nil
+	}
+	token := ""
+	if r.accessToken == AccessTokenHash {
+		token = payload.AccessTokenHashPrefix + data.Notification.Account()
+	}
+	n, raw, err := data.Notification.WithAccessToken(data.Raw, token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateFailure, err.Error())
+	}
+	cp := *data
+	cp.Notification = n
+	cp.Document = n.Document()
+	cp.Raw = raw
+	return &cp, nil
+}
+
+// IsEnveloped returns true if the body published to the target is to be wrapped in an envelope
+func (r *Rule) IsEnveloped() bool {
+	return r != nil && r.envelope
+}
+
+// toJSON encodes val as JSON so templates can safely embed values in JSON documents
+func toJSON(val interface{}) (string, error) {
+	enc, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+	return string(enc), nil
+}
+
+// isTruthy implements the JMESPath definition of truth
+func isTruthy(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
@@ -0,0 +1,231 @@
+package rules_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slugger/mstdnlambda/internal/payload"
+	"github.com/slugger/mstdnlambda/internal/rules"
+	"github.com/stretchr/testify/assert"
+)
+
+const testNotification = `{"access_token":"tok","notification_id":1,"notification_type":"mention","title":"You were mentioned by foo","body":"hello"}`
+
+func TestParseRejectsInvalidConfig(t *testing.T) {
+	testCases := []struct {
+		input string
+		desc  string
+	}{
+		{"not json", "not json"},
+		{`["arn"]`, "not an object"},
+		{`{"arn":{"filter":"notification_type =="}}`, "invalid expression"},
+		{`{"arn":{"filter":5}}`, "filter not a string"},
+		{`{"arn":{"envelope":"yes"}}`, "envelope not a boolean"},
+		{`{"arn":{"access_token":"redact"}}`, "unknown access_token policy"},
+		{`{"arn":{"access_token":"ref"}}`, "access_token reference policy"},
+		{`{"arn":{"template":"{{.Notification.Title"}}`, "unterminated template action"},
+		{`{"arn":{"template":"{{nosuchfunc .Raw}}"}}`, "undefined template function"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := rules.Parse(tc.input)
+			assert.ErrorIs(t, err, rules.ErrInvalidRule)
+		})
+	}
+}
+
+func TestForFallsBackToDefaultRule(t *testing.T) {
+	sut, err := rules.Parse(`{"bot":{"filter":"notification_type == 'follow'"},"*":{"filter":"notification_type == 'mention'"}}`)
+	assert.Nil(t, err)
+	doc := parse(t, testNotification)
+
+	matched, err := sut.For("bot").Matches(doc)
+	assert.Nil(t, err)
+	assert.False(t, matched)
+
+	matched, err = sut.For("archive").Matches(doc)
+	assert.Nil(t, err)
+	assert.True(t, matched)
+}
+
+func TestMissingRulesMatchEverything(t *testing.T) {
+	var sut *rules.Rules
+	matched, err := sut.For("bot").Matches(parse(t, testNotification))
+	assert.Nil(t, err)
+	assert.True(t, matched)
+
+	sut, err = rules.Parse(`{"bot":{}}`)
+	assert.Nil(t, err)
+	assert.Nil(t, sut.For("archive"))
+	matched, err = sut.For("bot").Matches(parse(t, testNotification))
+	assert.Nil(t, err)
+	assert.True(t, matched)
+}
+
+func TestFilterTruthiness(t *testing.T) {
+	testCases := []struct {
+		filter   string
+		expected bool
+	}{
+		{"contains(['mention', 'follow'], notification_type)", true},
+		{"notification_type == 'follow'", false},
+		{"contains(title, 'foo')", true},
+		{"missing_field", false},
+		{"title", true},
+		{"body == ''", false},
+		{"notification_id", true},
+		{"[]", false},
+		{"`{}`", false},
+		{"`0`", true},
+	}
+
+	doc := parse(t, testNotification)
+	for _, tc := range testCases {
+		t.Run(tc.filter, func(t *testing.T) {
+			sut, err := rules.Parse(`{"*":{"filter":` + quote(tc.filter) + `}}`)
+			if assert.Nil(t, err) {
+				matched, err := sut.For("any").Matches(doc)
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, matched)
+			}
+		})
+	}
+}
+
+func TestFilterEvaluationErrors(t *testing.T) {
+	sut, err := rules.Parse(`{"*":{"filter":"length(notification_id)"}}`)
+	assert.Nil(t, err)
+	_, err = sut.For("any").Matches(parse(t, testNotification))
+	assert.ErrorIs(t, err, rules.ErrFilterFailure)
+}
+
+func parse(t *testing.T, msg string) interface{} {
+	n, err := payload.Parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.Document()
+}
+
+func quote(val string) string {
+	enc, _ := json.Marshal(val)
+	return string(enc)
+}
+
+func TestRenderWithoutTemplateReturnsRawNotification(t *testing.T) {
+	data := templateData(t)
+	var sut *rules.Rules
+	body, err := sut.For("any").Render(data)
+	assert.Nil(t, err)
+	assert.Equal(t, testNotification, body)
+}
+
+func TestRenderExecutesTemplates(t *testing.T) {
+	testCases := []struct {
+		template string
+		expected string
+		desc     string
+	}{
+		{"{{.Notification.Title}}: {{.Notification.Body}}", "You were mentioned by foo: hello", "text line"},
+		{"{{.Raw}}", testNotification, "raw notification"},
+		{`{"instance":{{json .Instance}},"received_at":{{json .ReceivedAt}},"payload":{{.Raw}}}`, `{"instance":"mstdn.example","received_at":"2022-12-25T10:30:00Z","payload":` + testNotification + `}`, "envelope"},
+		{`{{index .Document "notification_type"}}`, "mention", "document field"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sut, err := rules.Parse(`{"*":{"template":` + quote(tc.template) + `}}`)
+			if assert.Nil(t, err) {
+				body, err := sut.For("any").Render(templateData(t))
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, body)
+			}
+		})
+	}
+}
+
+func TestRenderReportsExecutionErrors(t *testing.T) {
+	sut, err := rules.Parse(`{"*":{"template":"{{index .Document \"missing\"}}{{.Document.missing}}"}}`)
+	assert.Nil(t, err)
+	_, err = sut.For("any").Render(templateData(t))
+	assert.ErrorIs(t, err, rules.ErrTemplateFailure)
+}
+
+func templateData(t *testing.T) *rules.TemplateData {
+	n, err := payload.Parse(testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &rules.TemplateData{
+		Notification: n,
+		Document:     n.Document(),
+		Raw:          testNotification,
+		Instance:     "mstdn.example",
+		ReceivedAt:   time.Date(2022, 12, 25, 10, 30, 0, 0, time.UTC),
+	}
+}
+
+func TestIsEnveloped(t *testing.T) {
+	sut, err := rules.Parse(`{"archive":{"envelope":true},"*":{}}`)
+	assert.Nil(t, err)
+	assert.True(t, sut.For("archive").IsEnveloped())
+	assert.False(t, sut.For("bot").IsEnveloped())
+	assert.False(t, (*rules.Rules)(nil).For("archive").IsEnveloped())
+}
+
+func TestRenderAppliesAccessTokenPolicy(t *testing.T) {
+	sut, err := rules.Parse(`{
+		"keep":{"access_token":"keep"},
+		"drop":{"access_token":"drop"},
+		"hash":{"access_token":"hash"},
+		"tmpl":{"access_token":"drop","template":"[{{.Notification.AccessToken}}]{{.Raw}}"},
+		"*":{}
+	}`)
+	assert.Nil(t, err)
+
+	body, err := sut.For("keep").Render(templateData(t))
+	assert.Nil(t, err)
+	assert.Equal(t, testNotification, body)
+
+	body, err = sut.For("default").Render(templateData(t))
+	assert.Nil(t, err)
+	assert.Equal(t, testNotification, body)
+
+	body, err = sut.For("drop").Render(templateData(t))
+	assert.Nil(t, err)
+	assert.NotContains(t, body, "access_token")
+	assert.Contains(t, body, `"title":"You were mentioned by foo"`)
+
+	data := templateData(t)
+	body, err = sut.For("hash").Render(data)
+	assert.Nil(t, err)
+	assert.Contains(t, body, `"access_token":"hash:`+data.Notification.Account()+`"`)
+	assert.NotContains(t, body, `"tok"`)
+
+	body, err = sut.For("tmpl").Render(templateData(t))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(body, "[]{"))
+	assert.NotContains(t, body, "access_token")
+}
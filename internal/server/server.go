@@ -0,0 +1,245 @@
+package server
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+/*
+	The server package runs the lambda handler as a standalone HTTP server so
+	the gateway can be hosted outside of AWS Lambda, i.e. in a container or on
+	a VPS. Each HTTP request is adapted into the LambdaFunctionURLRequest a
+	function URL would have delivered and the handler's response is written
+	back to the client.
+
+	Server mode is enabled with the -listen command line flag, i.e. -listen :8080
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	mhttp "github.com/slugger/mstdnlambda/internal/http"
+	"github.com/slugger/mstdnlambda/internal/logging"
+)
+
+// MaxBodySize is the largest request body accepted; it matches the AWS Lambda invocation payload limit
+const MaxBodySize = 6 * 1024 * 1024
+
+// shutdownTimeout is how long in flight requests are given to complete once the server is asked to stop
+const shutdownTimeout = 30 * time.Second
+
+// HandlerFunc is the signature of the lambda handler served by the server
+type HandlerFunc func(context.Context, events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error)
+
+var listenAddr string
+
+func init() {
+	flag.StringVar(&listenAddr, "listen", "", "run as a standalone HTTP server listening on the given address, i.e. :8080")
+}
+
+// IsActive returns true if the lambda is to run as a standalone HTTP server
+func IsActive() bool {
+	return listenAddr != ""
+}
+
+// ListenAndServe serves fn on the address given by the -listen flag until the process receives SIGINT or SIGTERM
+func ListenAndServe(fn HandlerFunc) error {
+	log := logging.GetLogForCategory(logging.HTTPCategory)
+	srv := &http.Server{
+		Addr:              listenAddr,
+		Handler:           NewHandler(fn),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.WithField("signal", (<-sig).String()).Info("server stopping")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		stopped <- srv.Shutdown(ctx)
+	}()
+
+	if len(cfg.Cfg.Audiences()) == 0 && !cfg.Cfg.IsTrustForwardedHost() {
+		log.Warn("neither MSTDN_AUDIENCES nor MSTDN_TRUST_FORWARDED_HOST is set; no JWT audience is accepted")
+	}
+	log.WithField("addr", listenAddr).Info("server listening")
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("[listen failed] %w", err)
+	}
+	return <-stopped
+}
+
+// NewHandler returns an http.Handler that adapts each request into a function URL event for fn
+func NewHandler(fn HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := logging.GetLogForCategory(logging.HTTPCategory)
+		event, err := Adapt(r)
+		if err != nil {
+			log.WithField("err", err).Warn("request adapt failed")
+			if err = writeResponse(w, mhttp.EncodeError(err)); err != nil {
+				log.WithField("err", err).Error("response write failed")
+			}
+			return
+		}
+
+		ctx := logging.NewContext(r.Context(), logging.Log.WithField("requestId", event.RequestContext.RequestID))
+		log = logging.GetLogForContext(ctx, logging.HTTPCategory)
+		resp, err := fn(ctx, event)
+		if err != nil {
+			log.WithField("err", err).Error("request failed")
+			writeError(w, http.StatusInternalServerError, "fail")
+			return
+		}
+		if err = writeResponse(w, resp); err != nil {
+			log.WithField("err", err).Error("response write failed")
+		}
+	})
+}
+
+// Adapt converts r into the event a lambda function URL would have delivered for it
+func Adapt(r *http.Request) (events.LambdaFunctionURLRequest, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxBodySize+1))
+	if err != nil {
+		return events.LambdaFunctionURLRequest{}, fmt.Errorf("[body read failed] %w", err)
+	}
+	if len(body) > MaxBodySize {
+		return events.LambdaFunctionURLRequest{}, fmt.Errorf("[body read failed] %w: body exceeds %d bytes", mhttp.ErrTooLarge, MaxBodySize)
+	}
+
+	headers := make(map[string]string)
+	var cookies []string
+	for k, v := range r.Header {
+		if strings.EqualFold(k, "Cookie") {
+			cookies = append(cookies, v...)
+			continue
+		}
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+
+	query := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		query[k] = strings.Join(v, ",")
+	}
+
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+
+	now := time.Now()
+	return events.LambdaFunctionURLRequest{
+		Version:               "2.0",
+		RawPath:               r.URL.EscapedPath(),
+		RawQueryString:        r.URL.RawQuery,
+		Cookies:               cookies,
+		Headers:               headers,
+		QueryStringParameters: query,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			RequestID:  newRequestID(),
+			DomainName: domainName(r),
+			Time:       now.UTC().Format("02/Jan/2006:15:04:05 -0700"),
+			TimeEpoch:  now.UnixMilli(),
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Protocol:  r.Proto,
+				SourceIP:  sourceIP,
+				UserAgent: r.UserAgent(),
+			},
+		},
+		Body:            b64.StdEncoding.EncodeToString(body),
+		IsBase64Encoded: true,
+	}, nil
+}
+
+// domainName returns the domain name the JWT audience is derived from; the Host header is chosen by the client so it is only trusted when a proxy is trusted to set the forwarded host, otherwise the first configured audience is used
+func domainName(r *http.Request) string {
+	if auds := cfg.Cfg.Audiences(); len(auds) > 0 {
+		if u, err := url.Parse(auds[0]); err == nil {
+			return u.Host
+		}
+	}
+	if cfg.Cfg.IsTrustForwardedHost() {
+		return r.Host
+	}
+	return ""
+}
+
+func writeResponse(w http.ResponseWriter, resp *events.LambdaFunctionURLResponse) error {
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		var err error
+		if body, err = b64.StdEncoding.DecodeString(resp.Body); err != nil {
+			writeError(w, http.StatusInternalServerError, "fail")
+			return fmt.Errorf("[body decode failed] %w", err)
+		}
+	}
+
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	for _, c := range resp.Cookies {
+		w.Header().Add("Set-Cookie", c)
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	status := resp.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	return err
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"status":"%s"}`, msg)
+}
+
+// newRequestID generates a random request id in the same format as AWS request ids
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	id := hex.EncodeToString(buf)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", id[0:8], id[8:12], id[12:16], id[16:20], id[20:32])
+}
@@ -0,0 +1,164 @@
+package server_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	mhttp "github.com/slugger/mstdnlambda/internal/http"
+	"github.com/slugger/mstdnlambda/internal/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptBuildsFunctionURLEvent(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_TRUST_FORWARDED_HOST", "true")
+	cfg.ParseConfig()
+	req := httptest.NewRequest(http.MethodPost, "https://push.example.com/abc/def?x=1&x=2", strings.NewReader("\x00\x01binary"))
+	req.Header.Set("Authorization", "WebPush token")
+	req.Header.Add("Crypto-Key", "dh=abc")
+	req.Header.Add("Crypto-Key", "p256ecdsa=def")
+	req.Header.Set("Cookie", "a=b")
+	req.Header.Set("User-Agent", "Mastodon/4.0.2")
+	req.RemoteAddr = "10.1.2.3:5555"
+
+	event, err := server.Adapt(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "/abc/def", event.RawPath)
+	assert.Equal(t, "x=1&x=2", event.RawQueryString)
+	assert.Equal(t, "1,2", event.QueryStringParameters["x"])
+	assert.Equal(t, "WebPush token", event.Headers["authorization"])
+	assert.Equal(t, "dh=abc,p256ecdsa=def", event.Headers["crypto-key"])
+	assert.NotContains(t, event.Headers, "cookie")
+	assert.Equal(t, []string{"a=b"}, event.Cookies)
+	assert.Equal(t, "push.example.com", event.RequestContext.DomainName)
+	assert.Equal(t, http.MethodPost, event.RequestContext.HTTP.Method)
+	assert.Equal(t, "10.1.2.3", event.RequestContext.HTTP.SourceIP)
+	assert.Equal(t, "Mastodon/4.0.2", event.RequestContext.HTTP.UserAgent)
+	assert.NotEmpty(t, event.RequestContext.RequestID)
+	assert.True(t, event.IsBase64Encoded)
+	body, err := b64.StdEncoding.DecodeString(event.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "\x00\x01binary", string(body))
+}
+
+func TestAdaptOnlyTrustsHostHeaderWithTrustedProxy(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "https://evil.example/abc", strings.NewReader("data"))
+
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	cfg.ParseConfig()
+	event, err := server.Adapt(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "", event.RequestContext.DomainName)
+
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_AUDIENCES", "https://push.example.com")
+	cfg.ParseConfig()
+	event, err = server.Adapt(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "push.example.com", event.RequestContext.DomainName)
+}
+
+func TestAdaptRejectsOversizedBodies(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/abc", strings.NewReader(strings.Repeat("a", server.MaxBodySize+1)))
+	_, err := server.Adapt(req)
+	assert.ErrorIs(t, err, mhttp.ErrTooLarge)
+
+	req = httptest.NewRequest(http.MethodPost, "/abc", strings.NewReader(strings.Repeat("a", server.MaxBodySize)))
+	_, err = server.Adapt(req)
+	assert.Nil(t, err)
+}
+
+func TestHandlerReportsAdaptErrors(t *testing.T) {
+	sut := server.NewHandler(func(ctx context.Context, event events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
+		t.Fatal("handler called")
+		return nil, nil
+	})
+	testCases := []struct {
+		body     io.Reader
+		expected int
+		desc     string
+	}{
+		{strings.NewReader(strings.Repeat("a", server.MaxBodySize+1)), http.StatusRequestEntityTooLarge, "oversized body"},
+		{io.MultiReader(strings.NewReader("data"), &failingReader{}), http.StatusInternalServerError, "body read failure"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sut.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/abc", tc.body))
+			assert.Equal(t, tc.expected, w.Code)
+		})
+	}
+}
+
+func TestHandlerWritesLambdaResponse(t *testing.T) {
+	var received events.LambdaFunctionURLRequest
+	srv := httptest.NewServer(server.NewHandler(func(ctx context.Context, event events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
+		received = event
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: 201,
+			Headers:    map[string]string{"X-Foo": "bar"},
+			Body:       `{"status":"ok"}`,
+		}, nil
+	}))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/abc", "application/octet-stream", strings.NewReader("data"))
+	if assert.Nil(t, err) {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, 201, resp.StatusCode)
+		assert.Equal(t, "bar", resp.Header.Get("X-Foo"))
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, `{"status":"ok"}`, string(body))
+		assert.Equal(t, "/abc", received.RawPath)
+	}
+}
+
+func TestHandlerReportsHandlerErrors(t *testing.T) {
+	srv := httptest.NewServer(server.NewHandler(func(ctx context.Context, event events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
+		return nil, io.ErrUnexpectedEOF
+	}))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/abc", "application/octet-stream", strings.NewReader("data"))
+	if assert.Nil(t, err) {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, 500, resp.StatusCode)
+		assert.Equal(t, `{"status":"fail"}`, string(body))
+	}
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
@@ -0,0 +1,165 @@
+package tracing
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrSetupFailure represents an error caused by an exporter that could not be created
+var ErrSetupFailure = errors.New("tracing setup failed")
+
+// ServiceName is the service the spans are reported under unless OTEL_SERVICE_NAME is set
+const ServiceName = "mstdnlambda"
+
+const (
+	tracerName = "github.com/slugger/mstdnlambda"
+	// xrayHeader is the header X-Ray trace context is carried in
+	xrayHeader = "X-Amzn-Trace-Id"
+	// xrayEnvHeader is the env var the lambda runtime sets to the X-Ray trace header of the current invocation
+	xrayEnvHeader = "_X_AMZN_TRACE_ID"
+)
+
+// provider is the TracerProvider spans are created with; the default provider creates non-recording spans that only carry the incoming trace context
+var provider trace.TracerProvider = trace.NewNoopTracerProvider()
+var propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Setup configures tracing from the lambda configuration; without an exporter spans are not recorded but the incoming trace context is still propagated to the targets
+func Setup(ctx context.Context) error {
+	exporter := cfg.Cfg.TraceExporter()
+	if exporter == cfg.TraceExporterNone {
+		return nil
+	}
+
+	// the endpoint and headers are configured with the standard OTEL_EXPORTER_OTLP_* env vars; the default is a collector on localhost, i.e. the ADOT lambda layer
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSetupFailure, err.Error())
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String(ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSetupFailure, err.Error())
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithBatcher(exp), sdktrace.WithResource(res)}
+	prop := propagation.TextMapPropagator(propagation.TraceContext{})
+	if exporter == cfg.TraceExporterXRay {
+		opts = append(opts, sdktrace.WithIDGenerator(xray.NewIDGenerator()))
+		prop = propagation.NewCompositeTextMapPropagator(xray.Propagator{}, propagation.TraceContext{})
+	}
+	SetProvider(sdktrace.NewTracerProvider(opts...), prop)
+	return nil
+}
+
+// SetProvider replaces the TracerProvider and propagator used for all spans and returns the previous provider; used by tests to record spans in memory
+func SetProvider(p trace.TracerProvider, prop propagation.TextMapPropagator) trace.TracerProvider {
+	prev := provider
+	provider = p
+	propagator = prop
+	otel.SetTracerProvider(p)
+	otel.SetTextMapPropagator(prop)
+	return prev
+}
+
+// Start starts a span as a child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return provider.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, marking it as failed if err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// EndRequest ends the span of a request answered with the given HTTP status; server errors mark the span as failed
+func EndRequest(span trace.Span, status int, err error) {
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if err == nil && status >= 500 {
+		err = fmt.Errorf("request failed with status %d", status)
+	}
+	End(span, err)
+}
+
+// Extract returns ctx with the trace context of the request headers so spans continue the caller's trace; with X-Ray, the trace of the invocation is used when the request carries none
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	carrier := headerCarrier(headers)
+	if cfg.Cfg.TraceExporter() == cfg.TraceExporterXRay && carrier.Get(xrayHeader) == "" {
+		if v := os.Getenv(xrayEnvHeader); v != "" {
+			carrier = headerCarrier{strings.ToLower(xrayHeader): v}
+			for k, v := range headers {
+				carrier[k] = v
+			}
+		}
+	}
+	return propagator.Extract(ctx, carrier)
+}
+
+// Inject returns the trace context of ctx as key/value pairs to be delivered with a message so subscribers can continue the trace; empty when ctx has no valid span
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+// Flush exports the spans recorded so far; the lambda may be frozen once the invocation returns so it must be called before responding
+func Flush(ctx context.Context) error {
+	if p, ok := provider.(interface{ ForceFlush(context.Context) error }); ok {
+		return p.ForceFlush(ctx)
+	}
+	return nil
+}
+
+// headerCarrier reads request headers, which are normalized to lower case keys
+type headerCarrier map[string]string
+
+func (c headerCarrier) Get(key string) string { return c[strings.ToLower(key)] }
+
+func (c headerCarrier) Set(key string, value string) { c[strings.ToLower(key)] = value }
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,141 @@
+package tracing_test
+
+/*
+	mstdnlambda
+	Copyright (C) 2022 Battams, Derek <derek@battams.ca>
+
+	This program is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/slugger/mstdnlambda/internal/cfg"
+	"github.com/slugger/mstdnlambda/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceParent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+func TestSpansContinueTheIncomingTrace(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	cfg.ParseConfig()
+	rec := recordSpans(t, propagation.TraceContext{})
+
+	ctx := tracing.Extract(context.Background(), map[string]string{"traceparent": testTraceParent})
+	ctx, span := tracing.Start(ctx, "send")
+	attrs := tracing.Inject(ctx)
+	tracing.End(span, nil)
+
+	spans := rec.Ended()
+	if assert.Equal(t, 1, len(spans)) {
+		assert.Equal(t, "send", spans[0].Name())
+		assert.Equal(t, testTraceID, spans[0].SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+		assert.Equal(t, "00-"+testTraceID+"-"+spans[0].SpanContext().SpanID().String()+"-01", attrs["traceparent"])
+	}
+}
+
+func TestEndMarksFailedSpans(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	cfg.ParseConfig()
+	rec := recordSpans(t, propagation.TraceContext{})
+
+	_, span := tracing.Start(context.Background(), "decrypt")
+	tracing.End(span, errors.New("bad key"))
+	_, span = tracing.Start(context.Background(), "request")
+	tracing.EndRequest(span, 503, nil)
+	_, span = tracing.Start(context.Background(), "request")
+	tracing.EndRequest(span, 400, nil)
+
+	spans := rec.Ended()
+	if assert.Equal(t, 3, len(spans)) {
+		assert.Equal(t, codes.Error, spans[0].Status().Code)
+		assert.Equal(t, "bad key", spans[0].Status().Description)
+		assert.Equal(t, 1, len(spans[0].Events()))
+		assert.Equal(t, codes.Error, spans[1].Status().Code)
+		assert.Equal(t, codes.Unset, spans[2].Status().Code)
+	}
+}
+
+func TestInjectWithoutTraceIsEmpty(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	cfg.ParseConfig()
+	assert.Empty(t, tracing.Inject(context.Background()))
+}
+
+func TestExtractFallsBackToXRayInvocationTrace(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_TRACE_EXPORTER", "xray")
+	t.Setenv("_X_AMZN_TRACE_ID", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	cfg.ParseConfig()
+	recordSpans(t, propagation.NewCompositeTextMapPropagator(xray.Propagator{}, propagation.TraceContext{}))
+
+	sc := trace.SpanContextFromContext(tracing.Extract(context.Background(), map[string]string{}))
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", sc.TraceID().String())
+
+	// the request's own trace context takes precedence
+	sc = trace.SpanContextFromContext(tracing.Extract(context.Background(), map[string]string{"x-amzn-trace-id": "Root=1-5759e988-00000000e1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"}))
+	assert.Equal(t, "5759e98800000000e1be46a994272793", sc.TraceID().String())
+}
+
+func TestSetupRequiresExporter(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	cfg.ParseConfig()
+	orig := tracing.SetProvider(trace.NewNoopTracerProvider(), propagation.TraceContext{})
+	t.Cleanup(func() { tracing.SetProvider(orig, propagation.TraceContext{}) })
+
+	assert.Nil(t, tracing.Setup(context.Background()))
+	_, span := tracing.Start(context.Background(), "request")
+	assert.False(t, span.IsRecording())
+
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_TRACE_EXPORTER", "otlp")
+	cfg.ParseConfig()
+	assert.Nil(t, tracing.Setup(context.Background()))
+	_, span = tracing.Start(context.Background(), "request")
+	assert.True(t, span.IsRecording())
+}
+
+func TestParseConfigRejectsUnknownExporter(t *testing.T) {
+	t.Setenv("MSTDN_PRIVATE_KEY", "key")
+	t.Setenv("MSTDN_SHARED_SECRET", "secret")
+	t.Setenv("MSTDN_TRACE_EXPORTER", "jaeger")
+	assert.Panics(t, func() { cfg.ParseConfig() })
+}
+
+func recordSpans(t *testing.T, prop propagation.TextMapPropagator) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	orig := tracing.SetProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)), prop)
+	t.Cleanup(func() { tracing.SetProvider(orig, propagation.TraceContext{}) })
+	return rec
+}